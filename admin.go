@@ -0,0 +1,685 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"github.com/gorilla/pat"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+func init() {
+	r := pat.New()
+	r.Add("GET", `/admin/users`, handlerAdmin(admin_users))
+	r.Add("GET", `/admin/courses`, handlerAdmin(admin_courses))
+	r.Add("POST", `/admin/newcourse`, handlerAdminJson(admin_newcourse))
+	r.Add("POST", `/admin/clonecourse/{coursetag:[\w:_\-]+$}`, handlerAdminJson(admin_clonecourse))
+	r.Add("POST", `/admin/closecourse/{coursetag:[\w:_\-]+$}`, handlerAdminJson(admin_closecourse))
+	r.Add("POST", `/admin/reopencourse/{coursetag:[\w:_\-]+$}`, handlerAdminJson(admin_reopencourse))
+	r.Add("POST", `/admin/addinstructor/{coursetag:[\w:_\-]+$}`, handlerAdminJson(admin_addinstructor))
+	r.Add("POST", `/admin/removeinstructor/{coursetag:[\w:_\-]+$}`, handlerAdminJson(admin_removeinstructor))
+	r.Add("POST", `/admin/addadmin`, handlerAdminJson(admin_addadmin))
+	r.Add("POST", `/admin/removeadmin`, handlerAdminJson(admin_removeadmin))
+	r.Add("POST", `/admin/reloadproblemtypes`, handlerAdminJsonUnlocked(admin_reloadproblemtypes))
+	http.Handle("/admin/", r)
+}
+
+// course tags must be usable in URLs
+func validCourseTag(s string) bool {
+	if len(s) < 1 {
+		return false
+	}
+	for _, ch := range s {
+		if !unicode.IsLetter(ch) && !unicode.IsDigit(ch) && !strings.ContainsRune(":_-", ch) {
+			return false
+		}
+	}
+	return true
+}
+
+// normalizeEmail cleans up an email address, returning "" if it is not
+// a complete address
+func normalizeEmail(email string) string {
+	email = strings.ToLower(strings.TrimSpace(email))
+	if !strings.ContainsRune(email, '@') {
+		return ""
+	}
+	return email
+}
+
+type UserListing struct {
+	Email   string
+	Name    string
+	Courses []string
+}
+
+type AdminUsersResponse struct {
+	Administrators []*UserListing
+	Instructors    []*UserListing
+	Students       []*UserListing
+}
+
+type UsersByEmail []*UserListing
+
+func (p UsersByEmail) Len() int           { return len(p) }
+func (p UsersByEmail) Less(i, j int) bool { return p[i].Email < p[j].Email }
+func (p UsersByEmail) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+func getUserListing(email, name string, courses map[string]*CourseDB) *UserListing {
+	elt := &UserListing{
+		Email:   email,
+		Name:    name,
+		Courses: []string{},
+	}
+	for tag, _ := range courses {
+		elt.Courses = append(elt.Courses, tag)
+	}
+	sort.Strings(elt.Courses)
+	return elt
+}
+
+func admin_users(w http.ResponseWriter, r *http.Request, admin *AdministratorDB) {
+	resp := &AdminUsersResponse{
+		Administrators: []*UserListing{},
+		Instructors:    []*UserListing{},
+		Students:       []*UserListing{},
+	}
+	for _, elt := range administratorsByEmail {
+		resp.Administrators = append(resp.Administrators, getUserListing(elt.Email, elt.Name, nil))
+	}
+	for _, elt := range instructorsByEmail {
+		resp.Instructors = append(resp.Instructors, getUserListing(elt.Email, elt.Name, elt.Courses))
+	}
+	for _, elt := range studentsByEmail {
+		resp.Students = append(resp.Students, getUserListing(elt.Email, elt.Name, elt.Courses))
+	}
+	sort.Sort(UsersByEmail(resp.Administrators))
+	sort.Sort(UsersByEmail(resp.Instructors))
+	sort.Sort(UsersByEmail(resp.Students))
+
+	writeJson(w, r, resp)
+}
+
+type AdminCourseListing struct {
+	Tag         string
+	Name        string
+	Close       time.Time
+	Active      bool
+	Instructors []string
+	Students    int
+	Assignments int
+}
+
+func getAdminCourseListing(course *CourseDB) *AdminCourseListing {
+	elt := &AdminCourseListing{
+		Tag:         course.Tag,
+		Name:        course.Name,
+		Close:       course.Close,
+		Active:      time.Now().Before(course.Close),
+		Instructors: []string{},
+		Students:    len(course.Students),
+		Assignments: len(course.Assignments),
+	}
+	for email, _ := range course.Instructors {
+		elt.Instructors = append(elt.Instructors, email)
+	}
+	sort.Strings(elt.Instructors)
+	return elt
+}
+
+func admin_courses(w http.ResponseWriter, r *http.Request, admin *AdministratorDB) {
+	tags := []string{}
+	for tag, _ := range coursesByTag {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+
+	resp := []*AdminCourseListing{}
+	for _, tag := range tags {
+		resp = append(resp, getAdminCourseListing(coursesByTag[tag]))
+	}
+
+	writeJson(w, r, resp)
+}
+
+type NewCourse struct {
+	Tag   string
+	Name  string
+	Close time.Time
+}
+
+// checkNewCourse cleans up and validates a new course request,
+// reporting an error and returning false if it is not acceptable
+func checkNewCourse(w http.ResponseWriter, req *NewCourse) bool {
+	req.Tag = strings.TrimSpace(req.Tag)
+	req.Name = strings.TrimSpace(req.Name)
+	if !validCourseTag(req.Tag) {
+		log.Printf("Invalid course tag: %s", req.Tag)
+		http.Error(w, "Course tag must be letters, digits, and any of :_-", http.StatusBadRequest)
+		return false
+	}
+	if _, present := coursesByTag[req.Tag]; present {
+		log.Printf("Course %s already exists", req.Tag)
+		http.Error(w, "Course already exists", http.StatusBadRequest)
+		return false
+	}
+	if req.Name == "" {
+		log.Printf("Course missing name")
+		http.Error(w, "Course missing name", http.StatusBadRequest)
+		return false
+	}
+	if time.Now().After(req.Close) {
+		log.Printf("Course must close in the future")
+		http.Error(w, "Close time must be in the future", http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func admin_newcourse(w http.ResponseWriter, r *http.Request, db *sql.DB, admin *AdministratorDB, decoder *json.Decoder) {
+	req := new(NewCourse)
+	if err := decoder.Decode(req); err != nil {
+		log.Printf("Failure decoding JSON request: %v", err)
+		http.Error(w, "Failure decoding JSON request", http.StatusBadRequest)
+		return
+	}
+
+	if !checkNewCourse(w, req) {
+		return
+	}
+
+	// write to the database first
+	if _, err := db.Exec("insert into Course values (?, ?, ?)", req.Tag, req.Name, req.Close); err != nil {
+		log.Printf("DB error inserting Course: %v", err)
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+
+	course := &CourseDB{
+		Tag:         req.Tag,
+		Name:        req.Name,
+		Close:       req.Close,
+		Instructors: make(map[string]*InstructorDB),
+		Students:    make(map[string]*StudentDB),
+		Assignments: make(map[int64]*AssignmentDB),
+	}
+	mutex.Lock()
+	coursesByTag[course.Tag] = course
+	mutex.Unlock()
+
+	log.Printf("Course %s created by %s", course.Tag, admin.Email)
+
+	writeJson(w, r, getAdminCourseListing(course))
+}
+
+func getAdminCourse(w http.ResponseWriter, r *http.Request) *CourseDB {
+	courseTag := r.URL.Query().Get(":coursetag")
+	course, present := coursesByTag[courseTag]
+	if !present {
+		log.Printf("No such course: %s", courseTag)
+		http.Error(w, "Course not found", http.StatusNotFound)
+		return nil
+	}
+	return course
+}
+
+type CloneCourse struct {
+	Tag       string
+	Name      string
+	Close     time.Time
+	ShiftDays int
+	TermStart time.Time
+}
+
+type AssignmentDBsByID []*AssignmentDB
+
+func (p AssignmentDBsByID) Len() int           { return len(p) }
+func (p AssignmentDBsByID) Less(i, j int) bool { return p[i].ID < p[j].ID }
+func (p AssignmentDBsByID) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+// calendarDays counts the days from one date to another in the local time zone
+func calendarDays(from, to time.Time) int {
+	y1, m1, d1 := from.In(timeZone).Date()
+	y2, m2, d2 := to.In(timeZone).Date()
+	start := time.Date(y1, m1, d1, 0, 0, 0, 0, time.UTC)
+	end := time.Date(y2, m2, d2, 0, 0, 0, 0, time.UTC)
+	return int(end.Sub(start).Hours() / 24)
+}
+
+// shiftDays moves a time by whole days, keeping the same local time of day
+func shiftDays(t time.Time, days int) time.Time {
+	return t.In(timeZone).AddDate(0, 0, days)
+}
+
+func admin_clonecourse(w http.ResponseWriter, r *http.Request, db *sql.DB, admin *AdministratorDB, decoder *json.Decoder) {
+	source := getAdminCourse(w, r)
+	if source == nil {
+		return
+	}
+
+	req := new(CloneCourse)
+	if err := decoder.Decode(req); err != nil {
+		log.Printf("Failure decoding JSON request: %v", err)
+		http.Error(w, "Failure decoding JSON request", http.StatusBadRequest)
+		return
+	}
+
+	// sort the assignments so they get new IDs in the same order
+	assignments := []*AssignmentDB{}
+	for _, asst := range source.Assignments {
+		assignments = append(assignments, asst)
+	}
+	sort.Sort(AssignmentDBsByID(assignments))
+
+	// work out how far to move everything
+	days := req.ShiftDays
+	if !req.TermStart.IsZero() {
+		if days != 0 {
+			log.Printf("Clone request has both ShiftDays and TermStart")
+			http.Error(w, "Give ShiftDays or TermStart, not both", http.StatusBadRequest)
+			return
+		}
+		if len(assignments) > 0 {
+			// the earliest assignment opening marks the start of the old term
+			first := assignments[0].Open
+			for _, asst := range assignments {
+				if asst.Open.Before(first) {
+					first = asst.Open
+				}
+			}
+			days = calendarDays(first, req.TermStart)
+		} else if req.Close.IsZero() {
+			// with no assignments there is no start of the old term to
+			// line up with, so the close time cannot be worked out
+			log.Printf("Clone request has TermStart, but no assignments and no Close")
+			http.Error(w, "A course with no assignments needs Close or ShiftDays, not TermStart alone", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// name and close time default to those of the original course
+	course := &NewCourse{Tag: req.Tag, Name: req.Name, Close: req.Close}
+	if strings.TrimSpace(course.Name) == "" {
+		course.Name = source.Name
+	}
+	if course.Close.IsZero() {
+		course.Close = shiftDays(source.Close, days)
+	}
+	if !checkNewCourse(w, course) {
+		return
+	}
+
+	// write to the database first
+	txn, err := db.Begin()
+	if err != nil {
+		log.Printf("DB error starting transaction: %v", err)
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	defer txn.Rollback()
+
+	if _, err := txn.Exec("insert into Course values (?, ?, ?)", course.Tag, course.Name, course.Close); err != nil {
+		log.Printf("DB error inserting Course: %v", err)
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	for email, _ := range source.Instructors {
+		if _, err := txn.Exec("insert into CourseInstructor values (?, ?)", course.Tag, email); err != nil {
+			log.Printf("DB error inserting CourseInstructor: %v", err)
+			http.Error(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+	}
+	copies := []*AssignmentDB{}
+	for _, asst := range assignments {
+		elt := &AssignmentDB{
+			Problem:            asst.Problem,
+			ForCredit:          asst.ForCredit,
+			Open:               shiftDays(asst.Open, days),
+			Close:              shiftDays(asst.Close, days),
+			LateDays:           asst.LateDays,
+			LatePenalty:        asst.LatePenalty,
+			Weight:             asst.Weight,
+			MaxAttempts:        asst.MaxAttempts,
+			SubmitInterval:     asst.SubmitInterval,
+			DisableTestRuns:    asst.DisableTestRuns,
+			SolutionsByStudent: make(map[string]*SolutionDB),
+			Extensions:         make(map[string]time.Time),
+		}
+		result, err := txn.Exec("insert into Assignment values (null, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+			course.Tag,
+			elt.Problem.ID,
+			elt.ForCredit,
+			elt.Open,
+			elt.Close,
+			elt.LateDays,
+			elt.LatePenalty,
+			elt.Weight,
+			elt.MaxAttempts,
+			elt.SubmitInterval,
+			elt.DisableTestRuns)
+		if err != nil {
+			log.Printf("DB error inserting Assignment: %v", err)
+			http.Error(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+		if elt.ID, err = result.LastInsertId(); err != nil {
+			log.Printf("DB error getting ID of new Assignment: %v", err)
+			http.Error(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+		copies = append(copies, elt)
+	}
+
+	if err = txn.Commit(); err != nil {
+		log.Printf("DB error committing: %v", err)
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+
+	// update in-memory data structures
+	elt := &CourseDB{
+		Tag:         course.Tag,
+		Name:        course.Name,
+		Close:       course.Close,
+		Instructors: make(map[string]*InstructorDB),
+		Students:    make(map[string]*StudentDB),
+		Assignments: make(map[int64]*AssignmentDB),
+	}
+	mutex.Lock()
+	coursesByTag[elt.Tag] = elt
+	for email, instructor := range source.Instructors {
+		elt.Instructors[email] = instructor
+		instructor.Courses[elt.Tag] = elt
+	}
+	for _, asst := range copies {
+		asst.Course = elt
+		assignmentsByID[asst.ID] = asst
+		elt.Assignments[asst.ID] = asst
+		asst.Problem.Assignments[asst.ID] = asst
+		asst.Problem.Courses[elt.Tag] = elt
+	}
+	mutex.Unlock()
+
+	log.Printf("Course %s cloned from %s with %d assignments shifted %d days by %s",
+		elt.Tag, source.Tag, len(copies), days, admin.Email)
+
+	writeJson(w, r, getAdminCourseListing(elt))
+}
+
+// setCourseClose changes when a course closes
+func setCourseClose(w http.ResponseWriter, r *http.Request, db *sql.DB, course *CourseDB, closeTime time.Time) {
+	// write to the database first
+	if _, err := db.Exec("update Course set Close = ? where Tag = ?", closeTime, course.Tag); err != nil {
+		log.Printf("DB error updating Course %s: %v", course.Tag, err)
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+
+	mutex.Lock()
+	course.Close = closeTime
+	mutex.Unlock()
+
+	writeJson(w, r, getAdminCourseListing(course))
+}
+
+func admin_closecourse(w http.ResponseWriter, r *http.Request, db *sql.DB, admin *AdministratorDB, decoder *json.Decoder) {
+	course := getAdminCourse(w, r)
+	if course == nil {
+		return
+	}
+
+	now := time.Now().In(timeZone)
+	if now.After(course.Close) {
+		log.Printf("Course %s is already closed", course.Tag)
+		http.Error(w, "Course is already closed", http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("Course %s closed by %s", course.Tag, admin.Email)
+	setCourseClose(w, r, db, course, now)
+}
+
+type ReopenCourse struct {
+	Close time.Time
+}
+
+func admin_reopencourse(w http.ResponseWriter, r *http.Request, db *sql.DB, admin *AdministratorDB, decoder *json.Decoder) {
+	course := getAdminCourse(w, r)
+	if course == nil {
+		return
+	}
+
+	req := new(ReopenCourse)
+	if err := decoder.Decode(req); err != nil {
+		log.Printf("Failure decoding JSON request: %v", err)
+		http.Error(w, "Failure decoding JSON request", http.StatusBadRequest)
+		return
+	}
+	if time.Now().After(req.Close) {
+		log.Printf("Course must close in the future")
+		http.Error(w, "Close time must be in the future", http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("Course %s reopened until %v by %s", course.Tag, req.Close, admin.Email)
+	setCourseClose(w, r, db, course, req.Close)
+}
+
+type AdminUser struct {
+	Email string
+	Name  string
+}
+
+func admin_addinstructor(w http.ResponseWriter, r *http.Request, db *sql.DB, admin *AdministratorDB, decoder *json.Decoder) {
+	course := getAdminCourse(w, r)
+	if course == nil {
+		return
+	}
+
+	req := new(AdminUser)
+	if err := decoder.Decode(req); err != nil {
+		log.Printf("Failure decoding JSON request: %v", err)
+		http.Error(w, "Failure decoding JSON request", http.StatusBadRequest)
+		return
+	}
+	email, name := normalizeEmail(req.Email), strings.TrimSpace(req.Name)
+	if email == "" {
+		log.Printf("Invalid email address: %s", req.Email)
+		http.Error(w, "Must give a complete email address", http.StatusBadRequest)
+		return
+	}
+	if _, present := course.Instructors[email]; present {
+		log.Printf("%s already teaches %s", email, course.Tag)
+		http.Error(w, "Already an instructor for the course", http.StatusBadRequest)
+		return
+	}
+	instructor, present := instructorsByEmail[email]
+	if !present && name == "" {
+		log.Printf("New instructor missing name")
+		http.Error(w, "Name is required for a new instructor", http.StatusBadRequest)
+		return
+	}
+
+	// write to the database first
+	txn, err := db.Begin()
+	if err != nil {
+		log.Printf("DB error starting transaction: %v", err)
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	defer txn.Rollback()
+
+	if !present {
+		if _, err := txn.Exec("insert into Instructor values (?, ?)", email, name); err != nil {
+			log.Printf("DB error inserting Instructor: %v", err)
+			http.Error(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+	}
+	if _, err := txn.Exec("insert into CourseInstructor values (?, ?)", course.Tag, email); err != nil {
+		log.Printf("DB error inserting CourseInstructor: %v", err)
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+
+	if err = txn.Commit(); err != nil {
+		log.Printf("DB error committing: %v", err)
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+
+	// update in-memory data structures
+	mutex.Lock()
+	if !present {
+		instructor = &InstructorDB{
+			Email:   email,
+			Name:    name,
+			Courses: make(map[string]*CourseDB),
+		}
+		instructorsByEmail[email] = instructor
+	}
+	instructor.Courses[course.Tag] = course
+	course.Instructors[email] = instructor
+	mutex.Unlock()
+
+	log.Printf("%s added as instructor for %s by %s", email, course.Tag, admin.Email)
+
+	writeJson(w, r, getAdminCourseListing(course))
+}
+
+func admin_removeinstructor(w http.ResponseWriter, r *http.Request, db *sql.DB, admin *AdministratorDB, decoder *json.Decoder) {
+	course := getAdminCourse(w, r)
+	if course == nil {
+		return
+	}
+
+	req := new(AdminUser)
+	if err := decoder.Decode(req); err != nil {
+		log.Printf("Failure decoding JSON request: %v", err)
+		http.Error(w, "Failure decoding JSON request", http.StatusBadRequest)
+		return
+	}
+	email := normalizeEmail(req.Email)
+	instructor, present := course.Instructors[email]
+	if !present {
+		log.Printf("%s does not teach %s", req.Email, course.Tag)
+		http.Error(w, "Not an instructor for the course", http.StatusNotFound)
+		return
+	}
+
+	// the Instructor record stays, since comments refer to it
+	if _, err := db.Exec("delete from CourseInstructor where Course = ? and Instructor = ?", course.Tag, email); err != nil {
+		log.Printf("DB error deleting CourseInstructor: %v", err)
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+
+	mutex.Lock()
+	delete(course.Instructors, email)
+	delete(instructor.Courses, course.Tag)
+	mutex.Unlock()
+
+	log.Printf("%s removed as instructor for %s by %s", email, course.Tag, admin.Email)
+
+	writeJson(w, r, getAdminCourseListing(course))
+}
+
+func admin_addadmin(w http.ResponseWriter, r *http.Request, db *sql.DB, admin *AdministratorDB, decoder *json.Decoder) {
+	req := new(AdminUser)
+	if err := decoder.Decode(req); err != nil {
+		log.Printf("Failure decoding JSON request: %v", err)
+		http.Error(w, "Failure decoding JSON request", http.StatusBadRequest)
+		return
+	}
+	email, name := normalizeEmail(req.Email), strings.TrimSpace(req.Name)
+	if email == "" {
+		log.Printf("Invalid email address: %s", req.Email)
+		http.Error(w, "Must give a complete email address", http.StatusBadRequest)
+		return
+	}
+	if _, present := administratorsByEmail[email]; present {
+		log.Printf("%s is already an administrator", email)
+		http.Error(w, "Already an administrator", http.StatusBadRequest)
+		return
+	}
+
+	// default to the name on another record
+	if name == "" {
+		if elt, present := instructorsByEmail[email]; present {
+			name = elt.Name
+		} else if elt, present := studentsByEmail[email]; present {
+			name = elt.Name
+		}
+	}
+	if name == "" {
+		log.Printf("New administrator missing name")
+		http.Error(w, "Name is required for a new administrator", http.StatusBadRequest)
+		return
+	}
+
+	// write to the database first
+	if _, err := db.Exec("insert into Administrator values (?, ?)", email, name); err != nil {
+		log.Printf("DB error inserting Administrator: %v", err)
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+
+	mutex.Lock()
+	administratorsByEmail[email] = &AdministratorDB{Email: email, Name: name}
+	mutex.Unlock()
+
+	log.Printf("%s promoted to administrator by %s", email, admin.Email)
+
+	writeJson(w, r, getUserListing(email, name, nil))
+}
+
+func admin_removeadmin(w http.ResponseWriter, r *http.Request, db *sql.DB, admin *AdministratorDB, decoder *json.Decoder) {
+	req := new(AdminUser)
+	if err := decoder.Decode(req); err != nil {
+		log.Printf("Failure decoding JSON request: %v", err)
+		http.Error(w, "Failure decoding JSON request", http.StatusBadRequest)
+		return
+	}
+	email := normalizeEmail(req.Email)
+	if _, present := administratorsByEmail[email]; !present {
+		log.Printf("%s is not an administrator", req.Email)
+		http.Error(w, "Administrator not found", http.StatusNotFound)
+		return
+	}
+
+	// someone else has to do it, so there is always an administrator
+	if email == admin.Email {
+		log.Printf("Administrator %s tried to remove self", email)
+		http.Error(w, "Administrators cannot remove themselves", http.StatusForbidden)
+		return
+	}
+
+	// write to the database first
+	if _, err := db.Exec("delete from Administrator where Email = ?", email); err != nil {
+		log.Printf("DB error deleting Administrator: %v", err)
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+
+	mutex.Lock()
+	delete(administratorsByEmail, email)
+	mutex.Unlock()
+
+	log.Printf("%s removed as administrator by %s", email, admin.Email)
+}
+
+func admin_reloadproblemtypes(w http.ResponseWriter, r *http.Request, admin *AdministratorDB, decoder *json.Decoder) {
+	resp, err := refreshProblemTypes()
+	if err != nil {
+		log.Printf("Problem type refresh failed: %v", err)
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	writeJson(w, r, resp)
+}
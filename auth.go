@@ -1,7 +1,9 @@
 package main
 
 import (
-	"encoding/json"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
 	"fmt"
 	"github.com/gorilla/pat"
 	"github.com/gorilla/sessions"
@@ -14,80 +16,155 @@ import (
 
 func init() {
 	r := pat.New()
-	r.Add("POST", `/auth/login/browserid`, handlerNoAuth(auth_login_browserid))
-	r.Add("GET", `/auth/login/google`, handlerNoAuth(auth_login_google))
+	r.Add("GET", `/auth/login/{provider:[\w\-]+$}`, handlerNoAuth(auth_login))
+	r.Add("GET", `/auth/callback/{provider:[\w\-]+$}`, handlerNoAuth(auth_callback))
 	r.Add("POST", `/auth/logout`, handlerNoAuth(auth_logout))
 	r.Add("GET", `/auth/time`, http.HandlerFunc(auth_time))
+	r.Add("GET", `/auth/providers`, http.HandlerFunc(auth_providers))
 	http.Handle("/auth/", r)
 }
 
+// An AuthProvider verifies the identity of a user through a login
+// flow of redirects:
+//
+//   - /auth/login/NAME redirects the browser to LoginURL
+//   - the provider eventually sends the browser to /auth/callback/NAME
+//   - Verify checks the callback request and returns the email address
+//
+// Verify returns "" with no error if the login was refused.
+type AuthProvider interface {
+	LoginURL(r *http.Request, session *sessions.Session) (string, error)
+	Verify(r *http.Request, session *sessions.Session) (email string, err error)
+}
+
+type AuthProviderConfig struct {
+	// Name is used in login URLs: /auth/login/NAME
+	Name string
+
+	// Type is one of {oidc, local}
+	Type string
+
+	// OpenID Connect settings
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURI  string
+	Scopes       []string
+}
+
+var authProviders = make(map[string]AuthProvider)
+
+func setupAuthProviders() {
+	if len(config.AuthProviders) == 0 {
+		log.Fatalf("No authentication providers configured")
+	}
+
+	for _, elt := range config.AuthProviders {
+		if _, present := authProviders[elt.Name]; present || elt.Name == "" {
+			log.Fatalf("Authentication provider with missing or duplicate name: [%s]", elt.Name)
+		}
+		switch elt.Type {
+		case "oidc":
+			authProviders[elt.Name] = newOIDCProvider(elt)
+		case "local":
+			log.Printf("Warning: local authentication provider %s accepts logins without verification", elt.Name)
+			authProviders[elt.Name] = &LocalProvider{Name: elt.Name}
+		default:
+			log.Fatalf("Unknown authentication provider type for %s: %s", elt.Name, elt.Type)
+		}
+		log.Printf("Adding %s authentication provider %s", elt.Type, elt.Name)
+	}
+}
+
 func auth_time(w http.ResponseWriter, r *http.Request) {
 	writeJson(w, r, time.Now().In(timeZone))
 }
 
-func auth_login_browserid(w http.ResponseWriter, r *http.Request, session *sessions.Session) {
-	// get the assertion from the submitted form data
-	assertion := strings.TrimSpace(r.FormValue("Assertion"))
-	if assertion == "" {
-		log.Printf("Missing BrowserID assertion")
-		http.Error(w, "Missing BrowserID assertion", http.StatusBadRequest)
+// auth_providers lists the names of the login methods, in the order
+// they are configured, so the client can offer a button for each one
+func auth_providers(w http.ResponseWriter, r *http.Request) {
+	names := []string{}
+	for _, elt := range config.AuthProviders {
+		names = append(names, elt.Name)
+	}
+	writeJson(w, r, names)
+}
+
+func getAuthProvider(w http.ResponseWriter, r *http.Request) AuthProvider {
+	name := r.URL.Query().Get(":provider")
+	provider, present := authProviders[name]
+	if !present {
+		log.Printf("Unknown authentication provider: %s", name)
+		http.Error(w, "Unknown login method", http.StatusNotFound)
+		return nil
+	}
+	return provider
+}
+
+func auth_login(w http.ResponseWriter, r *http.Request, session *sessions.Session) {
+	provider := getAuthProvider(w, r)
+	if provider == nil {
 		return
 	}
 
-	// check for a successful login
-	email, err := browserid_verify(assertion)
+	u, err := provider.LoginURL(r, session)
 	if err != nil {
-		log.Printf("Error while verifying BrowserID login: %v", err)
-		http.Error(w, "Error while verifying BrowserID login", http.StatusInternalServerError)
+		log.Printf("Error starting login: %v", err)
+		http.Error(w, "Error starting login", http.StatusInternalServerError)
 		return
 	}
-	if email == "" {
-		log.Printf("BrowserID login failed")
-		http.Error(w, "Login failed", http.StatusForbidden)
+
+	// the provider may have stored values in the session
+	if err = session.Save(r, w); err != nil {
+		log.Printf("Error saving session: %v", err)
+		http.Error(w, "Error saving session", http.StatusInternalServerError)
 		return
 	}
 
-	log.Printf("BrowserID login for [%s]", email)
-
-	// create a login session cookie
-	createLoginSession(w, r, session, email, false)
+	http.Redirect(w, r, u, http.StatusFound)
 }
 
-func auth_login_google(w http.ResponseWriter, r *http.Request, session *sessions.Session) {
-	errorcode := strings.TrimSpace(r.URL.Query().Get("error"))
-	if errorcode != "" {
-		log.Printf("Error from Google OAuth2.0 login attempt: %s", errorcode)
-		http.Error(w, "Error from Google OAuth2.0 login attempt", http.StatusForbidden)
+func auth_callback(w http.ResponseWriter, r *http.Request, session *sessions.Session) {
+	provider := getAuthProvider(w, r)
+	if provider == nil {
 		return
 	}
 
-	code := strings.TrimSpace(r.URL.Query().Get("code"))
-	if code == "" {
-		log.Printf("Missing Google OAuth2.0 code")
-		http.Error(w, "Missing Google OAuth2.0 code", http.StatusBadRequest)
+	errorcode := strings.TrimSpace(r.URL.Query().Get("error"))
+	if errorcode != "" {
+		log.Printf("Error from login attempt: %s", errorcode)
+		http.Error(w, "Error from login attempt", http.StatusForbidden)
 		return
 	}
 
-	// check for a successful login
-	email, err := google_verify(code)
+	// check for a successful login. The provider clears its values from
+	// the session so the callback cannot be replayed, so the session is
+	// saved even if the login fails.
+	email, err := provider.Verify(r, session)
 	if err != nil {
-		log.Printf("Error while verifying Google OAuth2.0 code: %v", err)
-		http.Error(w, "Error while verifying Google OAuth2.0 code", http.StatusInternalServerError)
+		session.Save(r, w)
+		log.Printf("Error while verifying login: %v", err)
+		http.Error(w, "Error while verifying login", http.StatusInternalServerError)
 		return
 	}
 	if email == "" {
-		log.Printf("Google OAuth2.0 login failed")
+		session.Save(r, w)
+		log.Printf("Login failed")
 		http.Error(w, "Login failed", http.StatusForbidden)
 		return
 	}
 
-	log.Printf("Google OAuth2.0 login for [%s]", email)
+	log.Printf("%s login for [%s]", r.URL.Query().Get(":provider"), email)
 
 	// create a login session cookie
-	createLoginSession(w, r, session, email, true)
+	createLoginSession(w, r, session, email)
 }
 
 func auth_logout(w http.ResponseWriter, r *http.Request, session *sessions.Session) {
+	if !checkCsrfToken(w, r, session) {
+		return
+	}
+
 	expires := time.Date(1970, 0, 0, 0, 0, 1, 0, time.UTC)
 
 	// clear the session cookie
@@ -120,6 +197,12 @@ func auth_logout(w http.ResponseWriter, r *http.Request, session *sessions.Sessi
 		Expires: expires,
 		MaxAge:  -1,
 	})
+	http.SetCookie(w, &http.Cookie{
+		Name:    "codrilla-csrf",
+		Path:    "/",
+		Expires: expires,
+		MaxAge:  -1,
+	})
 	if email == nil {
 		log.Printf("Logout")
 	} else {
@@ -127,10 +210,12 @@ func auth_logout(w http.ResponseWriter, r *http.Request, session *sessions.Sessi
 	}
 }
 
-func createLoginSession(w http.ResponseWriter, r *http.Request, session *sessions.Session, email string, redirect bool) {
+func createLoginSession(w http.ResponseWriter, r *http.Request, session *sessions.Session, email string) {
 	// start by assuming this is a student
 	role := "student"
 
+	mutex.RLock()
+
 	// is this an instructor?
 	if _, present := instructorsByEmail[email]; present {
 		role = "instructor"
@@ -141,8 +226,19 @@ func createLoginSession(w http.ResponseWriter, r *http.Request, session *session
 		role = "admin"
 	}
 
+	mutex.RUnlock()
+
+	// every login gets a fresh token for state-changing requests
+	token, err := randomToken()
+	if err != nil {
+		log.Printf("Error generating CSRF token: %v", err)
+		http.Error(w, "Error creating session", http.StatusInternalServerError)
+		return
+	}
+
 	session.Values["role"] = role
 	session.Values["email"] = email
+	session.Values["csrf"] = token
 
 	// compute an expiration time
 	// we'll set it to 30 days, but set it to 4:00am
@@ -173,149 +269,68 @@ func createLoginSession(w http.ResponseWriter, r *http.Request, session *session
 		Expires: expires,
 		MaxAge:  int(expires.Sub(now).Seconds()),
 	})
+	http.SetCookie(w, &http.Cookie{
+		Name:    "codrilla-csrf",
+		Value:   token,
+		Path:    "/",
+		Expires: expires,
+		MaxAge:  int(expires.Sub(now).Seconds()),
+	})
 
-	if redirect {
-		http.Redirect(w, r, "/", http.StatusFound)
-	} else {
-		writeJson(w, r, map[string]string{"Email": email})
-	}
-}
-
-type BrowserIDVerificationResponse struct {
-	Status   string
-	Email    string
-	Audience string
-	Expires  int64
-	Issuer   string
-	Reason   string
+	http.Redirect(w, r, "/", http.StatusFound)
 }
 
-func browserid_verify(assertion string) (email string, err error) {
-	// try to verify the assertion with the Persona server
-	resp, err := http.PostForm(
-		config.BrowserIDVerifyURL,
-		url.Values{
-			"assertion": {assertion},
-			"audience":  {config.BrowserIDAudience},
-		})
-
-	if err != nil {
-		log.Printf("Failure contacting BrowserID verification server: %v", err)
-		return "", fmt.Errorf("Failure contacting verification server: %v", err)
-	}
-	defer resp.Body.Close()
-
-	// decode the body
-	verify := new(BrowserIDVerificationResponse)
-	if err = json.NewDecoder(resp.Body).Decode(verify); err != nil {
-		log.Printf("Failure decoding BrowserID verification: %v", err)
-		return "", fmt.Errorf("Failure decoding verification: %v", err)
-	}
-	if verify.Status == "failure" {
-		log.Printf("Failed BrowserID login: %s", verify.Reason)
-		return "", nil
-	} else if verify.Status != "okay" {
-		log.Printf("Failed BrowserID login with unknown status: %s", verify.Status)
-		return "", fmt.Errorf("Failed with unknown verification status: %s", verify.Status)
-	}
-
-	// sanity checks
-	if !strings.Contains(verify.Email, "@") {
-		return "", fmt.Errorf("Invalid email address from BrowserID login: [%s]", verify.Email)
+// randomToken returns a random string suitable for use as a nonce
+func randomToken() (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
 	}
-	if verify.Audience != config.BrowserIDAudience {
-		return "", fmt.Errorf("Wrong BrowserID audience: [%s] instead of [%s]", verify.Audience, config.BrowserIDAudience)
-	}
-
-	return strings.ToLower(verify.Email), nil
+	return base64.RawURLEncoding.EncodeToString(raw), nil
 }
 
-type GoogleOAuth20VerificationResponse struct {
-	AccessToken string `json:"access_token"`
-	ExpiresIn   int64  `json:"expires_in"`
-	TokenType   string `json:"token_type"`
+// tokensMatch compares secret tokens in constant time
+func tokensMatch(expected, actual string) bool {
+	return expected != "" && subtle.ConstantTimeCompare([]byte(expected), []byte(actual)) == 1
 }
 
-type GoogleUserinfoResponse struct {
-	ID            string `json:"id"`
-	Email         string `json:"email"`
-	VerifiedEmail bool   `json:"verified_email"`
+// checkCsrfToken verifies that a state-changing request carries the
+// token from the session. The token is given to the client in the
+// codrilla-csrf cookie, and the client must echo it back in the
+// X-CSRF-Token header, which another site cannot do.
+func checkCsrfToken(w http.ResponseWriter, r *http.Request, session *sessions.Session) bool {
+	token, _ := session.Values["csrf"].(string)
+	if !tokensMatch(token, r.Header.Get("X-CSRF-Token")) {
+		log.Printf("Missing or invalid CSRF token")
+		http.Error(w, "Missing or invalid CSRF token; try logging in again", http.StatusForbidden)
+		return false
+	}
+	return true
 }
 
-func google_verify(code string) (email string, err error) {
-	// try to verify the code with Google server
-	resp, err := http.PostForm(
-		config.GoogleVerifyURL,
-		url.Values{
-			"code":          {code},
-			"client_id":     {config.GoogleClientID},
-			"client_secret": {config.GoogleClientSecret},
-			"redirect_uri":  {config.GoogleRedirectURI},
-			"grant_type":    {"authorization_code"},
-		})
-
-	if err != nil {
-		log.Printf("Failure contacting Google OAuth2.0 verification server: %v", err)
-		return "", fmt.Errorf("Failure contacting verification server: %v", err)
-	}
-	if resp.StatusCode != 200 {
-		log.Printf("Google OAuth2.0 returned a non-200 response code: %d", resp.StatusCode)
-		return "", fmt.Errorf("Google server returned an error code")
-	}
-	defer resp.Body.Close()
-
-	// decode the body
-	verify := new(GoogleOAuth20VerificationResponse)
-	if err = json.NewDecoder(resp.Body).Decode(verify); err != nil {
-		log.Printf("Failure decoding Google OAuth2.0 verification: %v", err)
-		return "", fmt.Errorf("Failure decoding verification")
-	}
-
-	// sanity checks
-	if verify.AccessToken == "" {
-		return "", fmt.Errorf("Empty access token")
-	}
-	if verify.ExpiresIn < 1 {
-		return "", fmt.Errorf("Access token already expired")
-	}
-	if verify.TokenType != "Bearer" {
-		log.Printf("Token type was [%s]", verify.TokenType)
-		return "", fmt.Errorf("Non-bearer token type returned")
-	}
-
-	// use the access token to get the email address
-	client := &http.Client{}
-	req, err := http.NewRequest("GET", config.GoogleGetEmailURL, nil)
-	if err != nil {
-		log.Printf("Error creating request object to get email address: %v", err)
-		return "", fmt.Errorf("Error creating request to get email address")
-	}
-	req.Header.Set("Authorization", "OAuth "+verify.AccessToken)
-	if resp, err = client.Do(req); err != nil {
-		log.Printf("Request to get email address failed: %v", err)
-		return "", fmt.Errorf("Request to get email address failed")
-	}
-	if resp.StatusCode != 200 {
-		log.Printf("Google userinfo returned a non-200 response code: %d", resp.StatusCode)
-		return "", fmt.Errorf("Google userinfo server returned an error code")
-	}
-	defer resp.Body.Close()
+// LocalProvider logs in any email address supplied by the user with
+// no verification at all. It is meant for development use only:
+//
+//	GET /auth/login/NAME?email=someone@example.com
+type LocalProvider struct {
+	Name string
+}
 
-	// decode the body
-	info := new(GoogleUserinfoResponse)
-	if err = json.NewDecoder(resp.Body).Decode(info); err != nil {
-		log.Printf("Failure decoding Google userinfo: %v", err)
-		return "", fmt.Errorf("Failure decoding userinfo")
+func (p *LocalProvider) LoginURL(r *http.Request, session *sessions.Session) (string, error) {
+	u := &url.URL{
+		Path:     "/auth/callback/" + p.Name,
+		RawQuery: url.Values{"email": {r.FormValue("email")}}.Encode(),
 	}
+	return u.String(), nil
+}
 
-	if info.Email == "" {
-		return "", fmt.Errorf("Empty email address")
-	}
-	if !info.VerifiedEmail {
-		log.Printf("Warning: unverified email address for [%s]", info.Email)
+func (p *LocalProvider) Verify(r *http.Request, session *sessions.Session) (string, error) {
+	email := strings.ToLower(strings.TrimSpace(r.FormValue("email")))
+	if !strings.Contains(email, "@") {
+		log.Printf("Invalid email address for local login: [%s]", email)
+		return "", nil
 	}
-
-	return strings.ToLower(info.Email), nil
+	return email, nil
 }
 
 func checkSession(session *sessions.Session) (email string, err error) {
@@ -3,10 +3,12 @@ package main
 import (
 	"database/sql"
 	"encoding/json"
+	"fmt"
 	"github.com/gorilla/pat"
 	"log"
 	"net/http"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -15,151 +17,26 @@ func init() {
 	r := pat.New()
 	r.Add("GET", `/course/list`, handlerInstructor(course_list))
 	r.Add("GET", `/course/grades/{coursetag:[\w:_\-]+$}`, handlerInstructor(course_grades))
+	r.Add("GET", `/course/gradequeue/{coursetag:[\w:_\-]+$}`, handlerInstructor(course_gradequeue))
+	r.Add("GET", `/course/events/{coursetag:[\w:_\-]+$}`, handlerInstructorStream(course_events))
+	r.Add("GET", `/course/regrade/{id:\d+$}`, handlerInstructor(course_regrade))
+	r.Add("GET", `/course/gradingruns/{id:\d+$}`, handlerInstructor(course_gradingruns))
+	r.Add("GET", `/course/submissions/{id:\d+$}`, handlerInstructorUnlocked(course_submissions))
+	r.Add("POST", `/course/regradesubmission/{id:\d+$}`, handlerInstructorJson(course_regradesubmission))
+	r.Add("POST", `/course/regradeassignment/{id:\d+$}`, handlerInstructorJson(course_regradeassignment))
+	r.Add("POST", `/course/regradeproblem/{id:\d+$}`, handlerInstructorJson(course_regradeproblem))
 	r.Add("POST", `/course/newassignment/{coursetag:[\w:_\-]+$}`, handlerInstructorJson(course_newassignment))
+	r.Add("POST", `/course/scheduleassignments/{coursetag:[\w:_\-]+$}`, handlerInstructorJson(course_scheduleassignments))
+	r.Add("POST", `/course/updateassignment/{id:\d+$}`, handlerInstructorJson(course_updateassignment))
+	r.Add("POST", `/course/deleteassignment/{id:\d+$}`, handlerInstructorJson(course_deleteassignment))
+	r.Add("POST", `/course/grantextension/{id:\d+$}`, handlerInstructorJson(course_grantextension))
+	r.Add("POST", `/course/revokeextension/{id:\d+$}`, handlerInstructorJson(course_revokeextension))
+	r.Add("POST", `/course/comment/{id:\d+$}`, handlerInstructorJson(course_comment))
+	r.Add("POST", `/course/deletecomment/{id:\d+$}`, handlerInstructorJson(course_deletecomment))
 	r.Add("POST", `/course/courselistupload/{coursetag:[\w:_\-]+$}`, handlerInstructorJson(course_courselistupload))
 	http.Handle("/course/", r)
 }
 
-func course_courselistupload(w http.ResponseWriter, r *http.Request, db *sql.DB, instructor *InstructorDB, decoder *json.Decoder) {
-	courseTag := r.URL.Query().Get(":coursetag")
-	course, present := instructor.Courses[courseTag]
-	if !present {
-		log.Printf("Not an instructor for %s/course does not exist", courseTag)
-		http.Error(w, "Course not found", http.StatusNotFound)
-		return
-	}
-
-	now := time.Now().In(timeZone)
-	if now.After(course.Close) {
-		log.Printf("Course is closed")
-		http.Error(w, "Course is closed", http.StatusForbidden)
-		return
-	}
-
-	lst := [][]string{}
-	if err := decoder.Decode(&lst); err != nil {
-		log.Printf("Error decoding list of students: %v", err)
-		http.Error(w, "Error decoding list of students", http.StatusBadRequest)
-		return
-	}
-
-	if len(lst) == 0 {
-		log.Printf("Course cannot be populated with empty list")
-		http.Error(w, "Course cannot be populated with empty list", http.StatusBadRequest)
-		return
-	}
-
-	// validate the data
-	studentsToAdd := make(map[string]string)
-	studentsToRemove := make(map[string]bool)
-	for _, row := range lst {
-		if len(row) != 2 {
-			log.Printf("Row with wrong number of elements: %d instead of 2", len(row))
-			http.Error(w, "Data row of wrong size", http.StatusBadRequest)
-			return
-		}
-		row[0] = strings.TrimSpace(row[0])
-		row[1] = strings.ToLower(strings.TrimSpace(row[1]))
-		if len(row[0]) == 0 || len(row[1]) == 0 {
-			log.Printf("Row found with empty data")
-			http.Error(w, "Row found with empty data", http.StatusBadRequest)
-			return
-		}
-		if !strings.ContainsRune(row[1], '@') {
-			row[1] += config.StudentEmailDomain
-		}
-
-		name, email := row[0], row[1]
-		studentsToAdd[email] = name
-	}
-
-	// figure out who to remove
-	for _, student := range course.Students {
-		if _, present := studentsToAdd[student.Email]; !present {
-			studentsToRemove[student.Email] = true
-		}
-	}
-
-	// looks good, so start updating
-	txn, err := db.Begin()
-	if err != nil {
-		log.Printf("DB error starting transaction: %v", err)
-		http.Error(w, "DB error", http.StatusInternalServerError)
-		return
-	}
-	defer txn.Rollback()
-
-	// add/update students records
-	for email, name := range studentsToAdd {
-		student, present := studentsByEmail[email]
-		if !present {
-			if _, err := txn.Exec("insert into Student values (?, ?)", email, name); err != nil {
-				log.Printf("DB error inserting Student: %v", err)
-				http.Error(w, "DB error", http.StatusInternalServerError)
-				return
-			}
-		} else if student.Name != name {
-			if _, err := txn.Exec("update Student set Name = ? where Email = ?", name, email); err != nil {
-				log.Printf("DB error updating Student: %v", err)
-				http.Error(w, "DB error", http.StatusInternalServerError)
-				return
-			}
-		}
-
-		// add student to course if not already enrolled
-		if _, present = course.Students[email]; !present {
-			if _, err := txn.Exec("insert into CourseStudent values (?, ?)", course.Tag, email); err != nil {
-				log.Printf("DB error inserting CourseStudent: %v", err)
-				http.Error(w, "DB error", http.StatusInternalServerError)
-				return
-			}
-		}
-	}
-
-	// remove student records from course
-	for email, _ := range studentsToRemove {
-		if _, err := txn.Exec("delete from CourseStudent where Course = ? and Student = ?", course.Tag, email); err != nil {
-			log.Printf("DB error delete from CourseStudent: %v", err)
-			http.Error(w, "DB error", http.StatusInternalServerError)
-			return
-		}
-	}
-
-	// commit
-	if err = txn.Commit(); err != nil {
-		log.Printf("DB error committing: %v", err)
-		http.Error(w, "DB error", http.StatusInternalServerError)
-		return
-	}
-
-	// now update in-memory structures
-	// add/update students
-	for email, name := range studentsToAdd {
-		student, present := studentsByEmail[email]
-		if !present {
-			student = &StudentDB{
-				Email:                 email,
-				Name:                  name,
-				Courses:               make(map[string]*CourseDB),
-				SolutionsByAssignment: make(map[int64]*SolutionDB),
-			}
-			studentsByEmail[email] = student
-		}
-		if student.Name != name {
-			student.Name = name
-		}
-		student.Courses[course.Tag] = course
-		course.Students[email] = student
-	}
-
-	// delete students who have dropped
-	for email, _ := range studentsToRemove {
-		student := course.Students[email]
-		delete(course.Students, email)
-		delete(student.Courses, course.Tag)
-	}
-}
-
 type CourseListResponseElt struct {
 	Tag               string
 	Name              string
@@ -232,10 +109,79 @@ func course_list(w http.ResponseWriter, r *http.Request, instructor *InstructorD
 }
 
 type NewAssignment struct {
-	Problem   int64
-	Open      time.Time
-	Close     time.Time
-	ForCredit bool
+	Problem     int64
+	Open        time.Time
+	Close       time.Time
+	ForCredit   bool
+	LateDays    int
+	LatePenalty int
+
+	// missing (nil) means 1 for a new assignment; 0 leaves the
+	// assignment out of the course total
+	Weight *float64
+
+	// 0 means no limit
+	MaxAttempts    int
+	SubmitInterval int
+
+	DisableTestRuns bool
+}
+
+// assignmentSettingsError checks the settings shared by new and updated
+// assignments, returning an error suitable for the user if one is wrong
+func assignmentSettingsError(asst *NewAssignment) error {
+	if asst.LateDays < 0 {
+		return fmt.Errorf("LateDays must not be negative")
+	}
+	if asst.LatePenalty < 0 || asst.LatePenalty > 100 {
+		return fmt.Errorf("LatePenalty must be a percentage from 0 to 100")
+	}
+	if asst.Weight != nil && *asst.Weight < 0 {
+		return fmt.Errorf("Weight must not be negative")
+	}
+	if asst.MaxAttempts < 0 || asst.SubmitInterval < 0 {
+		return fmt.Errorf("MaxAttempts and SubmitInterval must not be negative")
+	}
+	return nil
+}
+
+func checkAssignmentSettings(w http.ResponseWriter, asst *NewAssignment) bool {
+	if err := assignmentSettingsError(asst); err != nil {
+		log.Printf("Invalid assignment settings: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// newAssignmentError applies the rules for a new assignment, filling in
+// defaults for a missing open time and weight
+func newAssignmentError(asst *NewAssignment, now time.Time) error {
+	// if the open time is missing, use now
+	if asst.Open.IsZero() || asst.Open.Year() < 2000 {
+		asst.Open = now
+	}
+
+	// it must not open in the past
+	if now.After(asst.Open) && !now.Equal(asst.Open) {
+		return fmt.Errorf("Open time must be in the future")
+	}
+
+	// it must not close in the past, or before it opens
+	if now.After(asst.Close) || asst.Close.Before(asst.Open) {
+		return fmt.Errorf("Close time must be in the future and after open time")
+	}
+
+	if err := assignmentSettingsError(asst); err != nil {
+		return err
+	}
+
+	// if the weight is missing, use 1
+	if asst.Weight == nil {
+		weight := 1.0
+		asst.Weight = &weight
+	}
+	return nil
 }
 
 func course_newassignment(w http.ResponseWriter, r *http.Request, db *sql.DB, instructor *InstructorDB, decoder *json.Decoder) {
@@ -269,32 +215,25 @@ func course_newassignment(w http.ResponseWriter, r *http.Request, db *sql.DB, in
 		return
 	}
 
-	// if the open time is missing, use now
-	if asst.Open.IsZero() || asst.Open.Year() < 2000 {
-		asst.Open = now
-	}
-
-	// it must not open in the past
-	if now.After(asst.Open) && !now.Equal(asst.Open) {
-		log.Printf("Open time must be in the future")
-		http.Error(w, "Open time must be in the future", http.StatusBadRequest)
-		return
-	}
-
-	// it must not close in the past, or before it opens
-	if now.After(asst.Close) || asst.Close.Before(asst.Open) {
-		log.Printf("Must close in the future after opening")
-		http.Error(w, "Close time must be in the future and after open time", http.StatusBadRequest)
+	if err := newAssignmentError(asst, now); err != nil {
+		log.Printf("Invalid new assignment: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
 	// write to the database first
-	result, err := db.Exec("insert into Assignment values (null, ?, ?, ?, ?, ?)",
+	result, err := db.Exec("insert into Assignment values (null, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
 		course.Tag,
 		problem.ID,
 		asst.ForCredit,
 		asst.Open,
-		asst.Close)
+		asst.Close,
+		asst.LateDays,
+		asst.LatePenalty,
+		*asst.Weight,
+		asst.MaxAttempts,
+		asst.SubmitInterval,
+		asst.DisableTestRuns)
 	if err != nil {
 		log.Printf("DB error inserting new Assignment: %v", err)
 		http.Error(w, "DB error", http.StatusInternalServerError)
@@ -307,7 +246,10 @@ func course_newassignment(w http.ResponseWriter, r *http.Request, db *sql.DB, in
 		return
 	}
 
-	// up date in-memory data structures
+	// update in-memory data structures
+	mutex.Lock()
+	defer mutex.Unlock()
+
 	elt := &AssignmentDB{
 		ID:                 id,
 		Course:             course,
@@ -315,7 +257,14 @@ func course_newassignment(w http.ResponseWriter, r *http.Request, db *sql.DB, in
 		ForCredit:          asst.ForCredit,
 		Open:               asst.Open,
 		Close:              asst.Close,
+		LateDays:           asst.LateDays,
+		LatePenalty:        asst.LatePenalty,
+		Weight:             *asst.Weight,
+		MaxAttempts:        asst.MaxAttempts,
+		SubmitInterval:     asst.SubmitInterval,
+		DisableTestRuns:    asst.DisableTestRuns,
 		SolutionsByStudent: make(map[string]*SolutionDB),
+		Extensions:         make(map[string]time.Time),
 	}
 	assignmentsByID[id] = elt
 	course.Assignments[id] = elt
@@ -323,55 +272,1149 @@ func course_newassignment(w http.ResponseWriter, r *http.Request, db *sql.DB, in
 	problem.Courses[course.Tag] = course
 }
 
-type CourseGradesResponseElt struct {
-	Name                    string
-	Email                   string
-	Assignments             []*AssignmentListing
-	Passed, Failed, Pending int
-}
+func getInstructorAssignment(w http.ResponseWriter, r *http.Request, instructor *InstructorDB) *AssignmentDB {
+	id, err := strconv.ParseInt(r.URL.Query().Get(":id"), 10, 64)
+	if err != nil {
+		log.Printf("Bad assignment ID: %s", r.URL.Query().Get(":id"))
+		http.Error(w, "Assignment not found", http.StatusNotFound)
+		return nil
+	}
 
-func course_grades(w http.ResponseWriter, r *http.Request, instructor *InstructorDB) {
-	courseTag := r.URL.Query().Get(":coursetag")
-	course, present := coursesByTag[courseTag]
+	// find the assignment
+	asst, present := assignmentsByID[id]
 	if !present {
-		log.Printf("No such course/not an instructor for course %s", courseTag)
-		http.Error(w, "Not found", http.StatusNotFound)
-		return
+		log.Printf("No such assignment: %d", id)
+		http.Error(w, "Assignment not found", http.StatusNotFound)
+		return nil
 	}
 
-	// get a list of students in sorted order
-	resp := []*CourseGradesResponseElt{}
-	order := []string{}
-	for email, _ := range course.Students {
-		order = append(order, email)
+	// make sure this instructor teaches the course
+	course := asst.Course
+	if _, present := instructor.Courses[course.Tag]; !present {
+		log.Printf("Not an instructor for %s", course.Tag)
+		http.Error(w, "Assignment not found", http.StatusNotFound)
+		return nil
 	}
-	sort.Strings(order)
 
-	// process each student
+	// make sure the course is active
 	now := time.Now().In(timeZone)
-	for _, email := range order {
-		student := course.Students[email]
-		elt := &CourseGradesResponseElt{
-			Email:       student.Email,
-			Name:        student.Name,
-			Assignments: []*AssignmentListing{},
+	if now.After(course.Close) {
+		log.Printf("Course %s is closed", course.Tag)
+		http.Error(w, "Course is closed", http.StatusForbidden)
+		return nil
+	}
+
+	return asst
+}
+
+func hasSubmissions(asst *AssignmentDB) bool {
+	for _, solution := range asst.SolutionsByStudent {
+		if len(solution.SubmissionsInOrder) > 0 {
+			return true
 		}
-		for _, asst := range course.Assignments {
-			asstListing := getAssignmentListing(asst, student)
-			if asstListing.Passed {
-				elt.Passed++
-			} else if now.Before(asst.Close) {
-				elt.Pending++
-			} else {
-				elt.Failed++
-			}
+	}
+	return false
+}
 
-			elt.Assignments = append(elt.Assignments, asstListing)
+// remove the links from a problem to an assignment, and to the
+// assignment's course if no other assignment in the course uses it
+func unlinkAssignmentProblem(asst *AssignmentDB) {
+	problem := asst.Problem
+	delete(problem.Assignments, asst.ID)
+	for _, elt := range problem.Assignments {
+		if elt.Course == asst.Course {
+			return
 		}
-		sort.Sort(AssignmentsByClose(elt.Assignments))
+	}
+	delete(problem.Courses, asst.Course.Tag)
+}
 
-		resp = append(resp, elt)
+// AssignmentUpdate is a change to an existing assignment. A field that
+// is missing (nil) keeps its current value.
+type AssignmentUpdate struct {
+	Problem     *int64
+	Open        *time.Time
+	Close       *time.Time
+	ForCredit   *bool
+	LateDays    *int
+	LatePenalty *int
+	Weight      *float64
+
+	MaxAttempts    *int
+	SubmitInterval *int
+
+	DisableTestRuns *bool
+}
+
+func course_updateassignment(w http.ResponseWriter, r *http.Request, db *sql.DB, instructor *InstructorDB, decoder *json.Decoder) {
+	asst := getInstructorAssignment(w, r, instructor)
+	if asst == nil {
+		return
 	}
 
-	writeJson(w, r, resp)
+	req := new(AssignmentUpdate)
+	if err := decoder.Decode(req); err != nil {
+		log.Printf("Failure decoding JSON request: %v", err)
+		http.Error(w, "Failure decoding JSON request", http.StatusBadRequest)
+		return
+	}
+
+	// start with the current settings and apply the changes
+	weight := asst.Weight
+	update := &NewAssignment{
+		Problem:         asst.Problem.ID,
+		Open:            asst.Open,
+		Close:           asst.Close,
+		ForCredit:       asst.ForCredit,
+		LateDays:        asst.LateDays,
+		LatePenalty:     asst.LatePenalty,
+		Weight:          &weight,
+		MaxAttempts:     asst.MaxAttempts,
+		SubmitInterval:  asst.SubmitInterval,
+		DisableTestRuns: asst.DisableTestRuns,
+	}
+	if req.Problem != nil {
+		update.Problem = *req.Problem
+	}
+	if req.Open != nil {
+		update.Open = *req.Open
+	}
+	if req.Close != nil {
+		update.Close = *req.Close
+	}
+	if req.ForCredit != nil {
+		update.ForCredit = *req.ForCredit
+	}
+	if req.LateDays != nil {
+		update.LateDays = *req.LateDays
+	}
+	if req.LatePenalty != nil {
+		update.LatePenalty = *req.LatePenalty
+	}
+	if req.Weight != nil {
+		update.Weight = req.Weight
+	}
+	if req.MaxAttempts != nil {
+		update.MaxAttempts = *req.MaxAttempts
+	}
+	if req.SubmitInterval != nil {
+		update.SubmitInterval = *req.SubmitInterval
+	}
+	if req.DisableTestRuns != nil {
+		update.DisableTestRuns = *req.DisableTestRuns
+	}
+
+	problem := asst.Problem
+	if update.Problem != problem.ID {
+		var present bool
+		if problem, present = problemsByID[update.Problem]; !present {
+			log.Printf("Problem %d not found", update.Problem)
+			http.Error(w, "Problem not found", http.StatusNotFound)
+			return
+		}
+
+		// submissions are tied to the old problem
+		if hasSubmissions(asst) {
+			log.Printf("Cannot change problem for assignment %d with submissions", asst.ID)
+			http.Error(w, "Cannot change the problem after students have submitted", http.StatusForbidden)
+			return
+		}
+	}
+
+	// a changed open time must not be in the past
+	now := time.Now().In(timeZone)
+	if !update.Open.Equal(asst.Open) && now.After(update.Open) {
+		log.Printf("Open time must be in the future")
+		http.Error(w, "Open time must be in the future", http.StatusBadRequest)
+		return
+	}
+
+	// it must not close before it opens
+	if update.Close.Before(update.Open) {
+		log.Printf("Must close after opening")
+		http.Error(w, "Close time must be after open time", http.StatusBadRequest)
+		return
+	}
+
+	if !checkAssignmentSettings(w, update) {
+		return
+	}
+
+	// write to the database first
+	_, err := db.Exec("update Assignment set Problem = ?, ForCredit = ?, Open = ?, Close = ?, LateDays = ?, LatePenalty = ?, Weight = ?, MaxAttempts = ?, SubmitInterval = ?, DisableTestRuns = ? where ID = ?",
+		problem.ID,
+		update.ForCredit,
+		update.Open,
+		update.Close,
+		update.LateDays,
+		update.LatePenalty,
+		*update.Weight,
+		update.MaxAttempts,
+		update.SubmitInterval,
+		update.DisableTestRuns,
+		asst.ID)
+	if err != nil {
+		log.Printf("DB error updating Assignment %d: %v", asst.ID, err)
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+
+	// update in-memory data structures
+	mutex.Lock()
+	if problem != asst.Problem {
+		unlinkAssignmentProblem(asst)
+		asst.Problem = problem
+		problem.Assignments[asst.ID] = asst
+		problem.Courses[asst.Course.Tag] = asst.Course
+	}
+	asst.ForCredit = update.ForCredit
+	asst.Open = update.Open
+	asst.Close = update.Close
+	asst.LateDays = update.LateDays
+	asst.LatePenalty = update.LatePenalty
+	asst.Weight = *update.Weight
+	asst.MaxAttempts = update.MaxAttempts
+	asst.SubmitInterval = update.SubmitInterval
+	asst.DisableTestRuns = update.DisableTestRuns
+	mutex.Unlock()
+
+	writeJson(w, r, getAssignmentListing(asst, nil))
+}
+
+func course_deleteassignment(w http.ResponseWriter, r *http.Request, db *sql.DB, instructor *InstructorDB, decoder *json.Decoder) {
+	asst := getInstructorAssignment(w, r, instructor)
+	if asst == nil {
+		return
+	}
+
+	// do not throw away student work
+	if hasSubmissions(asst) {
+		log.Printf("Cannot delete assignment %d with submissions", asst.ID)
+		http.Error(w, "Cannot delete an assignment after students have submitted", http.StatusForbidden)
+		return
+	}
+
+	txn, err := db.Begin()
+	if err != nil {
+		log.Printf("DB error starting transaction: %v", err)
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	defer txn.Rollback()
+
+	if _, err := txn.Exec("delete from Extension where Assignment = ?", asst.ID); err != nil {
+		log.Printf("DB error deleting Extensions for Assignment %d: %v", asst.ID, err)
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+
+	// solutions without submissions may still exist
+	if _, err := txn.Exec("delete from Solution where Assignment = ?", asst.ID); err != nil {
+		log.Printf("DB error deleting Solutions for Assignment %d: %v", asst.ID, err)
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	if _, err := txn.Exec("delete from Assignment where ID = ?", asst.ID); err != nil {
+		log.Printf("DB error deleting Assignment %d: %v", asst.ID, err)
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+
+	if err = txn.Commit(); err != nil {
+		log.Printf("DB error committing: %v", err)
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+
+	// update in-memory data structures
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	for email, solution := range asst.SolutionsByStudent {
+		delete(solutionsByID, solution.ID)
+		delete(solution.Student.SolutionsByAssignment, asst.ID)
+		delete(asst.SolutionsByStudent, email)
+	}
+	unlinkAssignmentProblem(asst)
+	delete(asst.Course.Assignments, asst.ID)
+	delete(assignmentsByID, asst.ID)
+}
+
+type Extension struct {
+	Student string
+	Close   time.Time
+}
+
+func getCourseStudent(w http.ResponseWriter, course *CourseDB, email string) *StudentDB {
+	email = strings.ToLower(strings.TrimSpace(email))
+	if email != "" && !strings.ContainsRune(email, '@') {
+		email += config.StudentEmailDomain
+	}
+	student, present := course.Students[email]
+	if !present {
+		log.Printf("Student %s not enrolled in %s", email, course.Tag)
+		http.Error(w, "Student not enrolled in course", http.StatusNotFound)
+		return nil
+	}
+	return student
+}
+
+func course_grantextension(w http.ResponseWriter, r *http.Request, db *sql.DB, instructor *InstructorDB, decoder *json.Decoder) {
+	asst := getInstructorAssignment(w, r, instructor)
+	if asst == nil {
+		return
+	}
+
+	ext := new(Extension)
+	if err := decoder.Decode(ext); err != nil {
+		log.Printf("Failure decoding JSON request: %v", err)
+		http.Error(w, "Failure decoding JSON request", http.StatusBadRequest)
+		return
+	}
+
+	student := getCourseStudent(w, asst.Course, ext.Student)
+	if student == nil {
+		return
+	}
+
+	// it must not close before it opens
+	if ext.Close.Before(asst.Open) {
+		log.Printf("Extension must close after opening")
+		http.Error(w, "Close time must be after open time", http.StatusBadRequest)
+		return
+	}
+
+	// write to the database first
+	_, err := db.Exec("insert or replace into Extension values (?, ?, ?)", asst.ID, student.Email, ext.Close)
+	if err != nil {
+		log.Printf("DB error inserting Extension: %v", err)
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+
+	mutex.Lock()
+	asst.Extensions[student.Email] = ext.Close
+	mutex.Unlock()
+
+	writeJson(w, r, getAssignmentListing(asst, student))
+}
+
+func course_revokeextension(w http.ResponseWriter, r *http.Request, db *sql.DB, instructor *InstructorDB, decoder *json.Decoder) {
+	asst := getInstructorAssignment(w, r, instructor)
+	if asst == nil {
+		return
+	}
+
+	ext := new(Extension)
+	if err := decoder.Decode(ext); err != nil {
+		log.Printf("Failure decoding JSON request: %v", err)
+		http.Error(w, "Failure decoding JSON request", http.StatusBadRequest)
+		return
+	}
+
+	student := getCourseStudent(w, asst.Course, ext.Student)
+	if student == nil {
+		return
+	}
+
+	if _, present := asst.Extensions[student.Email]; !present {
+		log.Printf("No extension for %s on assignment %d", student.Email, asst.ID)
+		http.Error(w, "Extension not found", http.StatusNotFound)
+		return
+	}
+
+	// write to the database first
+	_, err := db.Exec("delete from Extension where Assignment = ? and Student = ?", asst.ID, student.Email)
+	if err != nil {
+		log.Printf("DB error deleting Extension: %v", err)
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+
+	mutex.Lock()
+	delete(asst.Extensions, student.Email)
+	mutex.Unlock()
+
+	writeJson(w, r, getAssignmentListing(asst, student))
+}
+
+type CourseGradesResponseElt struct {
+	Name                    string
+	Email                   string
+	StudentID               string
+	Assignments             []*AssignmentListing
+	Passed, Failed, Pending int
+	Late                    int
+
+	// weighted credit for assignments that count and have opened
+	Points, Possible, Total float64
+}
+
+func course_grades(w http.ResponseWriter, r *http.Request, instructor *InstructorDB) {
+	courseTag := r.URL.Query().Get(":coursetag")
+	course, present := instructor.Courses[courseTag]
+	if !present {
+		log.Printf("No such course/not an instructor for course %s", courseTag)
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	// get a list of students in sorted order
+	resp := []*CourseGradesResponseElt{}
+	order := []string{}
+	for email, _ := range course.Students {
+		order = append(order, email)
+	}
+	sort.Strings(order)
+
+	// process each student
+	now := time.Now().In(timeZone)
+	for _, email := range order {
+		student := course.Students[email]
+		elt := &CourseGradesResponseElt{
+			Email:       student.Email,
+			Name:        student.Name,
+			StudentID:   student.StudentID,
+			Assignments: []*AssignmentListing{},
+		}
+		for _, asst := range course.Assignments {
+			asstListing := getAssignmentListing(asst, student)
+			if asstListing.Passed {
+				elt.Passed++
+				if asstListing.Late {
+					elt.Late++
+				}
+			} else if now.Before(getLateClose(asst, student)) {
+				elt.Pending++
+			} else {
+				elt.Failed++
+			}
+			if asst.ForCredit && !now.Before(asst.Open) {
+				elt.Points += asst.Weight * float64(asstListing.Credit)
+				elt.Possible += asst.Weight * 100
+			}
+
+			elt.Assignments = append(elt.Assignments, asstListing)
+		}
+		sort.Sort(AssignmentsByClose(elt.Assignments))
+		if elt.Possible > 0 {
+			elt.Total = 100 * elt.Points / elt.Possible
+		}
+
+		resp = append(resp, elt)
+	}
+
+	switch format := gradebookFormat(r); format {
+	case "json":
+		writeJson(w, r, resp)
+	case "csv":
+		writeCsv(w, r, course.Tag+"-grades.csv", gradebookCsv(course, resp))
+	case "canvas":
+		writeCsv(w, r, course.Tag+"-canvas.csv", gradebookCanvas(course, resp))
+	case "moodle":
+		writeCsv(w, r, course.Tag+"-moodle.csv", gradebookMoodle(course, resp))
+	default:
+		log.Printf("Unknown grade report format: %s", format)
+		http.Error(w, "Unknown format; must be one of json, csv, canvas, moodle", http.StatusBadRequest)
+	}
+}
+
+// course_events streams events as submissions for the course are
+// received and graded
+func course_events(w http.ResponseWriter, r *http.Request, instructor *InstructorDB) *eventStream {
+	courseTag := r.URL.Query().Get(":coursetag")
+	if _, present := instructor.Courses[courseTag]; !present {
+		log.Printf("No such course/not an instructor for course %s", courseTag)
+		http.Error(w, "Not found", http.StatusNotFound)
+		return nil
+	}
+
+	return openEventStream(courseTag, "")
+}
+
+type GradeQueueResponse struct {
+	Healthy  bool
+	Length   int
+	Pending  int
+	Position int
+	Oldest   *GradeQueueListing
+	Entries  []*GradeQueueListing
+}
+
+type GradeQueueListing struct {
+	Position   int
+	Student    string
+	Assignment int64
+	Name       string
+	TimeStamp  time.Time
+	Failures   int
+}
+
+func course_gradequeue(w http.ResponseWriter, r *http.Request, instructor *InstructorDB) {
+	courseTag := r.URL.Query().Get(":coursetag")
+	course, present := instructor.Courses[courseTag]
+	if !present {
+		log.Printf("No such course/not an instructor for course %s", courseTag)
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	queue := getGradeQueue()
+	resp := &GradeQueueResponse{
+		Healthy: gradersHealthy(),
+		Length:  len(queue),
+		Entries: []*GradeQueueListing{},
+	}
+
+	// find the entries for this course
+	for i, elt := range queue {
+		solution, present := solutionsByID[elt.SolutionID]
+		if !present || solution.Assignment.Course != course {
+			continue
+		}
+		listing := &GradeQueueListing{
+			Position:   i + 1,
+			Student:    solution.Student.Email,
+			Assignment: solution.Assignment.ID,
+			Name:       solution.Assignment.Problem.Name,
+			TimeStamp:  elt.TimeStamp,
+			Failures:   elt.Failures,
+		}
+		if resp.Position == 0 {
+			resp.Position = listing.Position
+		}
+		if resp.Oldest == nil || listing.TimeStamp.Before(resp.Oldest.TimeStamp) {
+			resp.Oldest = listing
+		}
+		resp.Entries = append(resp.Entries, listing)
+	}
+	resp.Pending = len(resp.Entries)
+
+	writeJson(w, r, resp)
+}
+
+// regradesByID[id]
+// a regrade is a batch of submissions sent back to the grader. Only
+// the in-memory record is kept, so regrades are forgotten at restart
+// (but the prior grade reports are kept in the database). Finished
+// regrades are dropped once they are older than regradeRetention.
+type RegradeDB struct {
+	ID          int64
+	Instructor  *InstructorDB
+	Started     time.Time
+	Submissions int
+
+	// whether each affected solution passed before the regrade
+	PassedBefore map[*SolutionDB]bool
+}
+
+var regradesByID = make(map[int64]*RegradeDB)
+var lastRegradeID int64
+
+const regradeRetention = 24 * time.Hour
+
+// pruneRegrades forgets finished regrades that started before the
+// retention period. The caller must hold the write lock.
+func pruneRegrades(now time.Time) {
+	for id, regrade := range regradesByID {
+		if now.Sub(regrade.Started) < regradeRetention {
+			continue
+		}
+		finished := true
+		for solution := range regrade.PassedBefore {
+			if firstUngraded(solution) >= 0 {
+				finished = false
+				break
+			}
+		}
+		if finished {
+			delete(regradesByID, id)
+		}
+	}
+}
+
+type RegradeChange struct {
+	Student    string
+	Assignment int64
+	Name       string
+	Before     bool
+	After      bool
+}
+
+type RegradeResponse struct {
+	ID          int64
+	Started     time.Time
+	Submissions int
+	Pending     int
+	Done        bool
+	Changes     []*RegradeChange
+}
+
+type RegradeSubmissionRequest struct {
+	Student    string
+	Submission int
+}
+
+// reportHasRun is true if the submission's current grade report is
+// the report of its latest grading run that produced one. Submissions
+// graded before runs were recorded have reports with no run.
+func reportHasRun(sub *SubmissionDB) bool {
+	for i := len(sub.GradingRuns) - 1; i >= 0; i-- {
+		if run := sub.GradingRuns[i]; len(run.GradeReport) > 0 {
+			return encodeGradeReport(run.GradeReport) == encodeGradeReport(sub.GradeReport)
+		}
+	}
+	return false
+}
+
+// regradeSubmissions clears the grade reports of the given submissions
+// and sends them back to the grader. The old reports are kept in the
+// submissions' grading runs.
+func regradeSubmissions(w http.ResponseWriter, r *http.Request, db *sql.DB, instructor *InstructorDB, subs []*SubmissionDB) {
+	if len(subs) == 0 {
+		log.Printf("No submissions to regrade")
+		http.Error(w, "No submissions to regrade", http.StatusNotFound)
+		return
+	}
+
+	now := time.Now().In(timeZone)
+	regrade := &RegradeDB{
+		Instructor:   instructor,
+		Started:      now,
+		Submissions:  len(subs),
+		PassedBefore: make(map[*SolutionDB]bool),
+	}
+
+	txn, err := db.Begin()
+	if err != nil {
+		log.Printf("DB error starting transaction: %v", err)
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	defer txn.Rollback()
+
+	// a report with no grading run of its own gets one made from it
+	// before it is cleared, so it is not lost
+	saved := make(map[*SubmissionDB]*GradingRunDB)
+
+	for _, sub := range subs {
+		solution := sub.Solution
+		if _, present := regrade.PassedBefore[solution]; !present {
+			regrade.PassedBefore[solution] = getAssignmentListing(solution.Assignment, solution.Student).Passed
+		}
+
+		// ungraded submissions are already waiting for the grader
+		if len(sub.GradeReport) == 0 {
+			continue
+		}
+
+		if !reportHasRun(sub) {
+			run := &GradingRunDB{
+				Started:     sub.TimeStamp,
+				GradeReport: sub.GradeReport,
+				Passed:      sub.Passed,
+			}
+			if version, ok := sub.GradeReport["Version"].(string); ok {
+				run.Version = version
+			}
+			if err := insertGradingRun(txn, sub, run); err != nil {
+				log.Printf("DB error saving grade report as a grading run: %v", err)
+				http.Error(w, "DB error", http.StatusInternalServerError)
+				return
+			}
+			saved[sub] = run
+		}
+
+		_, err := txn.Exec("update Submission set GradeReport = ?, Passed = ?, Score = ?, MaxScore = ? where Solution = ? and TimeStamp = ?",
+			"",
+			false,
+			0,
+			0,
+			solution.ID,
+			sub.TimeStamp)
+		if err != nil {
+			log.Printf("DB error clearing Submission grade report: %v", err)
+			http.Error(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err = txn.Commit(); err != nil {
+		log.Printf("DB error committing: %v", err)
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+
+	// update in-memory data structures
+	mutex.Lock()
+	for _, sub := range subs {
+		if run, present := saved[sub]; present {
+			sub.GradingRuns = append(sub.GradingRuns, run)
+		}
+		sub.GradeReport = make(map[string]interface{})
+		sub.Passed = false
+		sub.Score = 0
+		sub.MaxScore = 0
+	}
+	pruneRegrades(now)
+	lastRegradeID++
+	regrade.ID = lastRegradeID
+	regradesByID[regrade.ID] = regrade
+	mutex.Unlock()
+
+	for _, sub := range subs {
+		queueForGrading(sub)
+	}
+
+	log.Printf("Regrade %d: %d submissions", regrade.ID, len(subs))
+
+	writeJson(w, r, getRegradeResponse(regrade))
+}
+
+func getRegradeResponse(regrade *RegradeDB) *RegradeResponse {
+	resp := &RegradeResponse{
+		ID:          regrade.ID,
+		Started:     regrade.Started,
+		Submissions: regrade.Submissions,
+		Changes:     []*RegradeChange{},
+	}
+	for solution, before := range regrade.PassedBefore {
+		// only report on solutions that are finished
+		if firstUngraded(solution) >= 0 {
+			resp.Pending++
+			continue
+		}
+		asst := solution.Assignment
+		after := getAssignmentListing(asst, solution.Student).Passed
+		if after != before {
+			resp.Changes = append(resp.Changes, &RegradeChange{
+				Student:    solution.Student.Email,
+				Assignment: asst.ID,
+				Name:       asst.Problem.Name,
+				Before:     before,
+				After:      after,
+			})
+		}
+	}
+	sort.Sort(RegradeChangesByStudent(resp.Changes))
+	resp.Done = resp.Pending == 0
+
+	return resp
+}
+
+type RegradeChangesByStudent []*RegradeChange
+
+func (p RegradeChangesByStudent) Len() int { return len(p) }
+func (p RegradeChangesByStudent) Less(i, j int) bool {
+	if p[i].Student == p[j].Student {
+		return p[i].Assignment < p[j].Assignment
+	}
+	return p[i].Student < p[j].Student
+}
+func (p RegradeChangesByStudent) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+
+func course_regrade(w http.ResponseWriter, r *http.Request, instructor *InstructorDB) {
+	id, err := strconv.ParseInt(r.URL.Query().Get(":id"), 10, 64)
+	if err != nil {
+		log.Printf("Bad regrade ID: %s", r.URL.Query().Get(":id"))
+		http.Error(w, "Regrade not found", http.StatusNotFound)
+		return
+	}
+
+	regrade, present := regradesByID[id]
+	if !present || regrade.Instructor != instructor {
+		log.Printf("No such regrade for this instructor: %d", id)
+		http.Error(w, "Regrade not found", http.StatusNotFound)
+		return
+	}
+
+	writeJson(w, r, getRegradeResponse(regrade))
+}
+
+func course_regradesubmission(w http.ResponseWriter, r *http.Request, db *sql.DB, instructor *InstructorDB, decoder *json.Decoder) {
+	asst := getInstructorAssignment(w, r, instructor)
+	if asst == nil {
+		return
+	}
+
+	req := new(RegradeSubmissionRequest)
+	if err := decoder.Decode(req); err != nil {
+		log.Printf("Failure decoding JSON request: %v", err)
+		http.Error(w, "Failure decoding JSON request", http.StatusBadRequest)
+		return
+	}
+
+	student := getCourseStudent(w, asst.Course, req.Student)
+	if student == nil {
+		return
+	}
+
+	solution, present := asst.SolutionsByStudent[student.Email]
+	if !present || req.Submission < 0 || req.Submission >= len(solution.SubmissionsInOrder) {
+		log.Printf("Submission %d not found for %s on assignment %d", req.Submission, student.Email, asst.ID)
+		http.Error(w, "Submission not found", http.StatusNotFound)
+		return
+	}
+
+	regradeSubmissions(w, r, db, instructor, []*SubmissionDB{solution.SubmissionsInOrder[req.Submission]})
+}
+
+func course_regradeassignment(w http.ResponseWriter, r *http.Request, db *sql.DB, instructor *InstructorDB, decoder *json.Decoder) {
+	asst := getInstructorAssignment(w, r, instructor)
+	if asst == nil {
+		return
+	}
+
+	subs := []*SubmissionDB{}
+	for _, solution := range asst.SolutionsByStudent {
+		subs = append(subs, solution.SubmissionsInOrder...)
+	}
+
+	regradeSubmissions(w, r, db, instructor, subs)
+}
+
+func course_regradeproblem(w http.ResponseWriter, r *http.Request, db *sql.DB, instructor *InstructorDB, decoder *json.Decoder) {
+	id, err := strconv.ParseInt(r.URL.Query().Get(":id"), 10, 64)
+	if err != nil {
+		log.Printf("Bad problem ID: %s", r.URL.Query().Get(":id"))
+		http.Error(w, "Problem not found", http.StatusNotFound)
+		return
+	}
+	problem, present := problemsByID[id]
+	if !present {
+		log.Printf("Problem %d not found", id)
+		http.Error(w, "Problem not found", http.StatusNotFound)
+		return
+	}
+
+	// only touch active courses taught by this instructor
+	now := time.Now().In(timeZone)
+	subs := []*SubmissionDB{}
+	for _, asst := range problem.Assignments {
+		if _, present := instructor.Courses[asst.Course.Tag]; !present || now.After(asst.Course.Close) {
+			continue
+		}
+		for _, solution := range asst.SolutionsByStudent {
+			subs = append(subs, solution.SubmissionsInOrder...)
+		}
+	}
+
+	regradeSubmissions(w, r, db, instructor, subs)
+}
+
+type GradingRunListing struct {
+	Submission  int
+	TimeStamp   time.Time
+	Started     time.Time
+	Duration    int64
+	Grader      string
+	Version     string
+	Passed      bool
+	Error       string
+	GradeReport map[string]interface{}
+}
+
+// course_gradingruns lists every attempt to grade a student's
+// submissions for an assignment, oldest first
+func course_gradingruns(w http.ResponseWriter, r *http.Request, instructor *InstructorDB) {
+	asst := getInstructorAssignment(w, r, instructor)
+	if asst == nil {
+		return
+	}
+
+	student := getCourseStudent(w, asst.Course, r.URL.Query().Get("student"))
+	if student == nil {
+		return
+	}
+
+	// optionally limit it to a single submission
+	n := -1
+	if s := r.URL.Query().Get("submission"); s != "" {
+		n64, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || n64 < 0 {
+			log.Printf("Bad submission number: %s", s)
+			http.Error(w, "Submission not found", http.StatusNotFound)
+			return
+		}
+		n = int(n64)
+	}
+
+	resp := []*GradingRunListing{}
+	solution, present := asst.SolutionsByStudent[student.Email]
+	count := 0
+	if present {
+		count = len(solution.SubmissionsInOrder)
+	}
+	if n >= count {
+		log.Printf("Submission %d not found for %s on assignment %d", n, student.Email, asst.ID)
+		http.Error(w, "Submission not found", http.StatusNotFound)
+		return
+	}
+	for i := 0; i < count; i++ {
+		if n >= 0 && i != n {
+			continue
+		}
+		sub := solution.SubmissionsInOrder[i]
+		for _, run := range sub.GradingRuns {
+			resp = append(resp, &GradingRunListing{
+				Submission:  i,
+				TimeStamp:   sub.TimeStamp,
+				Started:     run.Started,
+				Duration:    int64(run.Duration / time.Millisecond),
+				Grader:      run.Grader,
+				Version:     run.Version,
+				Passed:      run.Passed,
+				Error:       run.Error,
+				GradeReport: run.GradeReport,
+			})
+		}
+	}
+
+	writeJson(w, r, resp)
+}
+
+type SubmissionListing struct {
+	Submission  int
+	TimeStamp   time.Time
+	Late        bool
+	Penalty     int
+	Graded      bool
+	Passed      bool
+	Score       float64
+	MaxScore    float64
+	Data        map[string]interface{}
+	GradeReport map[string]interface{}
+	Diff        map[string]string
+	Comments    []*CommentListing
+}
+
+// course_submissions lists every submission a student made for an
+// assignment, oldest first, with the changes since the one before. The
+// listings are copied out with the read lock held, and the diffs are
+// computed after it is released.
+func course_submissions(w http.ResponseWriter, r *http.Request, instructor *InstructorDB) {
+	mutex.RLock()
+	asst := getInstructorAssignment(w, r, instructor)
+	if asst == nil {
+		mutex.RUnlock()
+		return
+	}
+
+	student := getCourseStudent(w, asst.Course, r.URL.Query().Get("student"))
+	if student == nil {
+		mutex.RUnlock()
+		return
+	}
+
+	resp := []*SubmissionListing{}
+	solution, present := asst.SolutionsByStudent[student.Email]
+	if !present {
+		mutex.RUnlock()
+		writeJson(w, r, resp)
+		return
+	}
+
+	// instructors see each submission as the grader saw it
+	problem := asst.Problem
+	problemType := problem.Type
+	for i, sub := range solution.SubmissionsInOrder {
+		data := mergeForGrader(problem, sub.Submission)
+		elt := &SubmissionListing{
+			Submission:  i,
+			TimeStamp:   sub.TimeStamp,
+			Late:        sub.Late,
+			Penalty:     sub.Penalty,
+			Graded:      len(sub.GradeReport) > 0,
+			Passed:      sub.Passed,
+			Score:       sub.Score,
+			MaxScore:    sub.MaxScore,
+			Data:        data,
+			GradeReport: filterFields("grader", "edit", problemType, sub.GradeReport),
+			Diff:        make(map[string]string),
+			Comments:    []*CommentListing{},
+		}
+		for _, comment := range sub.Comments {
+			elt.Comments = append(elt.Comments, getCommentListing(comment, i))
+		}
+		resp = append(resp, elt)
+	}
+	mutex.RUnlock()
+
+	// compare text fields with the previous submission
+	for i := 1; i < len(resp); i++ {
+		prev, data := resp[i-1].Data, resp[i].Data
+		for _, field := range problemType.FieldList {
+			if field.Student != "edit" || field.List || field.Type == "int" || field.Type == "bool" {
+				continue
+			}
+			old, _ := prev[field.Name].(string)
+			new, _ := data[field.Name].(string)
+			if diff := lineDiff(old, new); diff != "" {
+				resp[i].Diff[field.Name] = diff
+			}
+		}
+	}
+
+	writeJson(w, r, resp)
+}
+
+type CommentListing struct {
+	ID         int64
+	Submission int
+	Instructor string
+	Created    time.Time
+	Line       int
+	Body       string
+	Read       bool
+}
+
+func getCommentListing(comment *CommentDB, n int) *CommentListing {
+	return &CommentListing{
+		ID:         comment.ID,
+		Submission: n,
+		Instructor: comment.Instructor.Email,
+		Created:    comment.Created,
+		Line:       comment.Line,
+		Body:       comment.Body,
+		Read:       comment.Read,
+	}
+}
+
+// getCommentListings lists the comments on all of a solution's
+// submissions, in order of submission and then of creation
+func getCommentListings(solution *SolutionDB) []*CommentListing {
+	list := []*CommentListing{}
+	for i, sub := range solution.SubmissionsInOrder {
+		for _, comment := range sub.Comments {
+			list = append(list, getCommentListing(comment, i))
+		}
+	}
+	return list
+}
+
+type NewComment struct {
+	Student    string
+	Submission int
+	Line       int
+	Body       string
+}
+
+func course_comment(w http.ResponseWriter, r *http.Request, db *sql.DB, instructor *InstructorDB, decoder *json.Decoder) {
+	asst := getInstructorAssignment(w, r, instructor)
+	if asst == nil {
+		return
+	}
+
+	req := new(NewComment)
+	if err := decoder.Decode(req); err != nil {
+		log.Printf("Failure decoding JSON request: %v", err)
+		http.Error(w, "Failure decoding JSON request", http.StatusBadRequest)
+		return
+	}
+
+	student := getCourseStudent(w, asst.Course, req.Student)
+	if student == nil {
+		return
+	}
+
+	solution, present := asst.SolutionsByStudent[student.Email]
+	if !present || req.Submission < 0 || req.Submission >= len(solution.SubmissionsInOrder) {
+		log.Printf("Submission %d not found for %s on assignment %d", req.Submission, student.Email, asst.ID)
+		http.Error(w, "Submission not found", http.StatusNotFound)
+		return
+	}
+	sub := solution.SubmissionsInOrder[req.Submission]
+
+	req.Body = strings.TrimSpace(req.Body)
+	if req.Body == "" {
+		log.Printf("Comment missing body")
+		http.Error(w, "Comment must not be empty", http.StatusBadRequest)
+		return
+	}
+
+	// a line number must refer to a line of the Candidate code
+	if req.Line != 0 {
+		candidate, _ := sub.Submission["Candidate"].(string)
+		if req.Line < 0 || req.Line > len(splitLines(candidate)) {
+			log.Printf("Comment line %d out of range", req.Line)
+			http.Error(w, "Line number is not in the submitted code", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// write to the database first
+	now := time.Now().In(timeZone)
+	result, err := db.Exec("insert into Comment values (null, ?, ?, ?, ?, ?, ?, ?)",
+		solution.ID,
+		sub.TimeStamp,
+		instructor.Email,
+		now,
+		req.Line,
+		req.Body,
+		false)
+	if err != nil {
+		log.Printf("DB error inserting Comment: %v", err)
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		log.Printf("DB error getting ID of new Comment: %v", err)
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+
+	comment := &CommentDB{
+		ID:         id,
+		Submission: sub,
+		Instructor: instructor,
+		Created:    now,
+		Line:       req.Line,
+		Body:       req.Body,
+	}
+	mutex.Lock()
+	commentsByID[id] = comment
+	sub.Comments = append(sub.Comments, comment)
+	mutex.Unlock()
+
+	writeJson(w, r, getCommentListing(comment, req.Submission))
+}
+
+func course_deletecomment(w http.ResponseWriter, r *http.Request, db *sql.DB, instructor *InstructorDB, decoder *json.Decoder) {
+	id, err := strconv.ParseInt(r.URL.Query().Get(":id"), 10, 64)
+	if err != nil {
+		log.Printf("Bad comment ID: %s", r.URL.Query().Get(":id"))
+		http.Error(w, "Comment not found", http.StatusNotFound)
+		return
+	}
+
+	// make sure this instructor teaches the course
+	comment, present := commentsByID[id]
+	if present {
+		_, present = instructor.Courses[comment.Submission.Solution.Assignment.Course.Tag]
+	}
+	if !present {
+		log.Printf("No such comment for this instructor: %d", id)
+		http.Error(w, "Comment not found", http.StatusNotFound)
+		return
+	}
+
+	// write to the database first
+	if _, err := db.Exec("delete from Comment where ID = ?", id); err != nil {
+		log.Printf("DB error deleting Comment %d: %v", id, err)
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	sub := comment.Submission
+	for i, elt := range sub.Comments {
+		if elt == comment {
+			sub.Comments = append(sub.Comments[:i], sub.Comments[i+1:]...)
+			break
+		}
+	}
+	delete(commentsByID, id)
 }
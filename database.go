@@ -10,7 +10,19 @@ import (
 )
 
 var database *sql.DB
+
+// The in-memory data structures are guarded by two locks:
+//
+// mutex is held for reading by every request that looks at the data,
+// and for writing only while a change is being applied to it.
+//
+// writeMutex serializes requests that make changes. A writer holds it
+// while validating the request, updating the database, and applying
+// the change in memory, so it can read the data without also holding
+// mutex. Database commits happen without mutex, so readers only wait
+// while the in-memory change itself is made.
 var mutex sync.RWMutex
+var writeMutex sync.Mutex
 
 func initDatabase() {
 	mutex.Lock()
@@ -19,6 +31,9 @@ func initDatabase() {
 		log.Fatalf("Error opening %s: %v", config.DatabaseName, err)
 	}
 
+	// bring a database made from an older schema up to date
+	migrateDatabase(db)
+
 	// read entire database into memory, one table at a time
 	log.Printf("reading %s", config.DatabaseName)
 	ScanAdministratorTable(db)
@@ -31,13 +46,167 @@ func initDatabase() {
 	ScanProblemTable(db)
 	ScanProblemTagTable(db)
 	ScanAssignmentTable(db)
+	ScanExtensionTable(db)
 	ScanSolutionTable(db)
 	ScanSubmissionTable(db)
+	ScanGradingRunTable(db)
+	ScanCommentTable(db)
 
 	database = db
 	mutex.Unlock()
 }
 
+// schemaMigration is one step in bringing an older database up to date
+// with schema.sql. A step is needed if its table (or its column, if one
+// is given) is missing. New columns are added to the end of a table, so
+// steps for the same table must stay in the order the columns appear in
+// schema.sql.
+type schemaMigration struct {
+	Table  string
+	Column string
+	Sql    []string
+}
+
+var schemaMigrations = []*schemaMigration{
+	{Table: "Student", Column: "StudentID", Sql: []string{
+		"alter table Student add column StudentID text not null default ''",
+	}},
+	{Table: "Extension", Sql: []string{
+		`create table Extension (
+			Assignment integer not null,
+			Student text not null,
+			Close timestamp not null,
+
+			primary key (Assignment, Student),
+			foreign key (Assignment) references Assignment (ID),
+			foreign key (Student) references Student (Email)
+		)`,
+	}},
+	{Table: "Assignment", Column: "LateDays", Sql: []string{
+		"alter table Assignment add column LateDays integer not null default 0",
+	}},
+	{Table: "Assignment", Column: "LatePenalty", Sql: []string{
+		"alter table Assignment add column LatePenalty integer not null default 0",
+	}},
+	{Table: "Submission", Column: "Late", Sql: []string{
+		"alter table Submission add column Late integer not null default 0",
+	}},
+	{Table: "Submission", Column: "Penalty", Sql: []string{
+		"alter table Submission add column Penalty integer not null default 0",
+	}},
+	{Table: "GradingRun", Sql: []string{
+		`create table GradingRun (
+			Solution integer not null,
+			TimeStamp timestamp not null,
+			Started timestamp not null,
+			Duration integer not null,
+			Grader text not null,
+			Version text not null,
+			GradeReport text not null,
+			Passed integer,
+			Error text not null,
+
+			foreign key (Solution, TimeStamp) references Submission (Solution, TimeStamp)
+		)`,
+		"create index gradingrun_submission on GradingRun (Solution, TimeStamp)",
+	}},
+	{Table: "Assignment", Column: "Weight", Sql: []string{
+		"alter table Assignment add column Weight real not null default 1",
+	}},
+	{Table: "Submission", Column: "Score", Sql: []string{
+		"alter table Submission add column Score real not null default 0",
+	}},
+	{Table: "Submission", Column: "MaxScore", Sql: []string{
+		"alter table Submission add column MaxScore real not null default 0",
+	}},
+	{Table: "Assignment", Column: "MaxAttempts", Sql: []string{
+		"alter table Assignment add column MaxAttempts integer not null default 0",
+	}},
+	{Table: "Assignment", Column: "SubmitInterval", Sql: []string{
+		"alter table Assignment add column SubmitInterval integer not null default 0",
+	}},
+	{Table: "Assignment", Column: "DisableTestRuns", Sql: []string{
+		"alter table Assignment add column DisableTestRuns integer not null default 0",
+	}},
+	{Table: "Comment", Sql: []string{
+		`create table Comment (
+			ID integer primary key autoincrement,
+			Solution integer not null,
+			TimeStamp timestamp not null,
+			Instructor text not null,
+			Created timestamp not null,
+			Line integer not null default 0,
+			Body text not null,
+			Read integer not null default 0,
+
+			foreign key (Solution, TimeStamp) references Submission (Solution, TimeStamp),
+			foreign key (Instructor) references Instructor (Email)
+		)`,
+	}},
+}
+
+func tableExists(db *sql.DB, table string) (bool, error) {
+	var count int
+	err := db.QueryRow("select count(*) from sqlite_master where type = 'table' and name = ?", table).Scan(&count)
+	return count > 0, err
+}
+
+func columnExists(db *sql.DB, table, column string) (bool, error) {
+	rows, err := db.Query("pragma table_info(" + table + ")")
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var cid, notnull, pk int
+		var name, kind string
+		var dflt sql.NullString
+		if err = rows.Scan(&cid, &name, &kind, &notnull, &dflt, &pk); err != nil {
+			return false, err
+		}
+		if name == column {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
+
+// migrateDatabase applies every schema migration that a database still
+// needs, so it is safe to run at each start
+func migrateDatabase(db *sql.DB) {
+	for _, step := range schemaMigrations {
+		var present bool
+		var err error
+		name := step.Table
+		if step.Column == "" {
+			present, err = tableExists(db, step.Table)
+		} else {
+			name += "." + step.Column
+			present, err = columnExists(db, step.Table, step.Column)
+		}
+		if err != nil {
+			log.Fatalf("DB error checking schema for %s: %v", name, err)
+		}
+		if present {
+			continue
+		}
+
+		log.Printf("migrating database: %s", name)
+		txn, err := db.Begin()
+		if err != nil {
+			log.Fatalf("DB error starting transaction: %v", err)
+		}
+		for _, stmt := range step.Sql {
+			if _, err = txn.Exec(stmt); err != nil {
+				log.Fatalf("DB error migrating %s: %v", name, err)
+			}
+		}
+		if err = txn.Commit(); err != nil {
+			log.Fatalf("DB error committing migration of %s: %v", name, err)
+		}
+	}
+}
+
 //
 // Data types
 //
@@ -99,6 +268,7 @@ func ScanInstructorTable(db *sql.DB) {
 type StudentDB struct {
 	Email                 string
 	Name                  string
+	StudentID             string
 	Courses               map[string]*CourseDB
 	SolutionsByAssignment map[int64]*SolutionDB
 }
@@ -115,7 +285,7 @@ func ScanStudentTable(db *sql.DB) {
 		elt := new(StudentDB)
 		elt.Courses = make(map[string]*CourseDB)
 		elt.SolutionsByAssignment = make(map[int64]*SolutionDB)
-		if err = rows.Scan(&elt.Email, &elt.Name); err != nil {
+		if err = rows.Scan(&elt.Email, &elt.Name, &elt.StudentID); err != nil {
 			log.Fatalf("DB error scanning Student: %v", err)
 		}
 		studentsByEmail[elt.Email] = elt
@@ -230,7 +400,17 @@ type ProblemDB struct {
 }
 
 var problemsByID = make(map[int64]*ProblemDB)
-var outputByProblemID = make(map[int64]interface{})
+
+// outputByProblemID[id]
+// the expected output from the grader, with the problem data it was
+// found for (encoded as JSON)
+type CachedOutput struct {
+	Data   string
+	Output interface{}
+}
+
+var outputByProblemID = make(map[int64]*CachedOutput)
+var outputMutex sync.Mutex
 
 func ScanProblemTable(db *sql.DB) {
 	rows, err := db.Query("select * from Problem")
@@ -288,7 +468,14 @@ type AssignmentDB struct {
 	ForCredit          bool
 	Open               time.Time
 	Close              time.Time
+	LateDays           int
+	LatePenalty        int
+	Weight             float64
+	MaxAttempts        int
+	SubmitInterval     int
+	DisableTestRuns    bool
 	SolutionsByStudent map[string]*SolutionDB
+	Extensions         map[string]time.Time
 }
 
 var assignmentsByID = make(map[int64]*AssignmentDB)
@@ -302,9 +489,10 @@ func ScanAssignmentTable(db *sql.DB) {
 	for rows.Next() {
 		elt := new(AssignmentDB)
 		elt.SolutionsByStudent = make(map[string]*SolutionDB)
+		elt.Extensions = make(map[string]time.Time)
 		var course string
 		var problem int64
-		if err = rows.Scan(&elt.ID, &course, &problem, &elt.ForCredit, &elt.Open, &elt.Close); err != nil {
+		if err = rows.Scan(&elt.ID, &course, &problem, &elt.ForCredit, &elt.Open, &elt.Close, &elt.LateDays, &elt.LatePenalty, &elt.Weight, &elt.MaxAttempts, &elt.SubmitInterval, &elt.DisableTestRuns); err != nil {
 			log.Fatalf("DB error scanning Assignment: %v", err)
 		}
 		elt.Course = coursesByTag[course]
@@ -318,6 +506,69 @@ func ScanAssignmentTable(db *sql.DB) {
 	}
 }
 
+// AssignmentDB.Extensions[email] = Close
+func ScanExtensionTable(db *sql.DB) {
+	rows, err := db.Query("select * from Extension")
+	if err != nil {
+		log.Fatalf("DB error selecting from Extension: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var assignment int64
+		var student string
+		var closeTime time.Time
+		if err = rows.Scan(&assignment, &student, &closeTime); err != nil {
+			log.Fatalf("DB error scanning Extension: %v", err)
+		}
+		assignmentsByID[assignment].Extensions[student] = closeTime
+	}
+}
+
+// get the close time for an assignment, including any extension
+// granted to the student
+func getClose(asst *AssignmentDB, student *StudentDB) time.Time {
+	if student != nil {
+		if closeTime, present := asst.Extensions[student.Email]; present {
+			return closeTime
+		}
+	}
+	return asst.Close
+}
+
+// get the end of the late window for an assignment, which starts
+// when the assignment closes for the student
+func getLateClose(asst *AssignmentDB, student *StudentDB) time.Time {
+	return getClose(asst, student).AddDate(0, 0, asst.LateDays)
+}
+
+// get the percentage penalty for a submission made at the given time:
+// each day or partial day past the close time costs LatePenalty percent
+func getLatePenalty(asst *AssignmentDB, student *StudentDB, when time.Time) int {
+	late := when.Sub(getClose(asst, student))
+	if late <= 0 {
+		return 0
+	}
+	days := int((late + 24*time.Hour - 1) / (24 * time.Hour))
+	penalty := days * asst.LatePenalty
+	if penalty > 100 {
+		penalty = 100
+	}
+	return penalty
+}
+
+// get the percentage of credit earned by a graded submission: the
+// share of the score if the grader gave one, otherwise all or nothing
+// depending on whether it passed, less any late penalty
+func getCredit(sub *SubmissionDB) float64 {
+	credit := 0.0
+	if sub.MaxScore > 0 {
+		credit = 100 * sub.Score / sub.MaxScore
+	} else if sub.Passed {
+		credit = 100
+	}
+	return credit * float64(100-sub.Penalty) / 100
+}
+
 // solutionsByID[id]
 // StudentDB.SolutionsByAssignment[asstID]
 // AssignmentDB.SolutionsByStudent[email]
@@ -353,12 +604,21 @@ func ScanSolutionTable(db *sql.DB) {
 }
 
 // SolutionDB.SubmissionsInOrder[]
+// GradeReport, Passed, Score, and MaxScore are from the latest
+// grading run that produced a report. MaxScore is zero if the grader
+// did not give a score.
 type SubmissionDB struct {
 	Solution    *SolutionDB
 	TimeStamp   time.Time
 	Submission  map[string]interface{}
 	GradeReport map[string]interface{}
 	Passed      bool
+	Late        bool
+	Penalty     int
+	Score       float64
+	MaxScore    float64
+	GradingRuns []*GradingRunDB
+	Comments    []*CommentDB
 }
 
 func ScanSubmissionTable(db *sql.DB) {
@@ -372,7 +632,7 @@ func ScanSubmissionTable(db *sql.DB) {
 		var solution int64
 		var submissionJson string
 		var gradeReportJson string
-		if err = rows.Scan(&solution, &elt.TimeStamp, &submissionJson, &gradeReportJson, &elt.Passed); err != nil {
+		if err = rows.Scan(&solution, &elt.TimeStamp, &submissionJson, &gradeReportJson, &elt.Passed, &elt.Late, &elt.Penalty, &elt.Score, &elt.MaxScore); err != nil {
 			log.Fatalf("DB error scanning Submission: %v", err)
 		}
 		elt.Solution = solutionsByID[solution]
@@ -381,12 +641,115 @@ func ScanSubmissionTable(db *sql.DB) {
 		}
 		if gradeReportJson == "" {
 			elt.GradeReport = make(map[string]interface{})
-
-			// missing grade report? add this to the grading queue
-			gradeQueue[solution] = true
 		} else if err = json.Unmarshal([]byte(gradeReportJson), &elt.GradeReport); err != nil {
 			log.Fatalf("JSON error in GradeReport for Solution %d at %v: %v", elt.Solution.ID, elt.TimeStamp, err)
 		}
 		elt.Solution.SubmissionsInOrder = append(elt.Solution.SubmissionsInOrder, elt)
+		if len(elt.GradeReport) == 0 {
+			// missing grade report? add this to the grading queue
+			queueForGrading(elt)
+		}
+	}
+}
+
+// SubmissionDB.GradingRuns[]
+// a grading run is one attempt to grade a submission, successful or not
+type GradingRunDB struct {
+	Started     time.Time
+	Duration    time.Duration
+	Grader      string
+	Version     string
+	GradeReport map[string]interface{}
+	Passed      bool
+	Error       string
+}
+
+// submissions are identified by solution and time stamp
+type submissionKey struct {
+	Solution  int64
+	TimeStamp int64
+}
+
+func indexSubmissions() map[submissionKey]*SubmissionDB {
+	submissions := make(map[submissionKey]*SubmissionDB)
+	for _, solution := range solutionsByID {
+		for _, sub := range solution.SubmissionsInOrder {
+			submissions[submissionKey{solution.ID, sub.TimeStamp.UnixNano()}] = sub
+		}
+	}
+	return submissions
+}
+
+func ScanGradingRunTable(db *sql.DB) {
+	submissions := indexSubmissions()
+
+	rows, err := db.Query("select * from GradingRun order by Started")
+	if err != nil {
+		log.Fatalf("DB error selecting from GradingRun: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		elt := new(GradingRunDB)
+		var solution int64
+		var timestamp time.Time
+		var duration int64
+		var gradeReportJson string
+		if err = rows.Scan(&solution, &timestamp, &elt.Started, &duration, &elt.Grader, &elt.Version, &gradeReportJson, &elt.Passed, &elt.Error); err != nil {
+			log.Fatalf("DB error scanning GradingRun: %v", err)
+		}
+		elt.Duration = time.Duration(duration) * time.Millisecond
+		if gradeReportJson == "" {
+			elt.GradeReport = make(map[string]interface{})
+		} else if err = json.Unmarshal([]byte(gradeReportJson), &elt.GradeReport); err != nil {
+			log.Fatalf("JSON error in GradingRun for Solution %d at %v: %v", solution, timestamp, err)
+		}
+		sub, present := submissions[submissionKey{solution, timestamp.UnixNano()}]
+		if !present {
+			log.Fatalf("GradingRun found for missing Submission: Solution %d at %v", solution, timestamp)
+		}
+		sub.GradingRuns = append(sub.GradingRuns, elt)
+	}
+}
+
+// commentsByID[id]
+// SubmissionDB.Comments[]
+// Line is 0 for a comment on the whole submission, or the line number
+// (starting at 1) of the Candidate field it refers to
+type CommentDB struct {
+	ID         int64
+	Submission *SubmissionDB
+	Instructor *InstructorDB
+	Created    time.Time
+	Line       int
+	Body       string
+	Read       bool
+}
+
+var commentsByID = make(map[int64]*CommentDB)
+
+func ScanCommentTable(db *sql.DB) {
+	submissions := indexSubmissions()
+
+	rows, err := db.Query("select * from Comment order by Created")
+	if err != nil {
+		log.Fatalf("DB error selecting from Comment: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		elt := new(CommentDB)
+		var solution int64
+		var timestamp time.Time
+		var instructor string
+		if err = rows.Scan(&elt.ID, &solution, &timestamp, &instructor, &elt.Created, &elt.Line, &elt.Body, &elt.Read); err != nil {
+			log.Fatalf("DB error scanning Comment: %v", err)
+		}
+		sub, present := submissions[submissionKey{solution, timestamp.UnixNano()}]
+		if !present {
+			log.Fatalf("Comment %d found for missing Submission: Solution %d at %v", elt.ID, solution, timestamp)
+		}
+		elt.Submission = sub
+		elt.Instructor = instructorsByEmail[instructor]
+		commentsByID[elt.ID] = elt
+		sub.Comments = append(sub.Comments, elt)
 	}
 }
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"strings"
+)
+
+// lines beyond this many in either version are not diffed, since the
+// comparison takes time and space proportional to the product of the
+// two lengths
+const maxDiffLines = 500
+
+// lineDiff compares two versions of a text line by line and returns
+// the result in the style of diff: lines only in the old version are
+// prefixed with "-", lines only in the new version with "+", and lines
+// in both with " ". The result is
+// empty if the two are the same.
+func lineDiff(old, new string) string {
+	if old == new {
+		return ""
+	}
+	a := splitLines(old)
+	b := splitLines(new)
+	if len(a) > maxDiffLines || len(b) > maxDiffLines {
+		return "(too long to compare)\n"
+	}
+
+	// lcs[i][j] is the length of the longest common subsequence of
+	// a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var out []string
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			out = append(out, " "+a[i])
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			out = append(out, "-"+a[i])
+			i++
+		default:
+			out = append(out, "+"+b[j])
+			j++
+		}
+	}
+
+	// make sure every line ends with a newline
+	for n, line := range out {
+		if !strings.HasSuffix(line, "\n") {
+			out[n] = line + "\n"
+		}
+	}
+	return strings.Join(out, "")
+}
+
+// splitLines splits text into lines, keeping the newlines
+func splitLines(s string) []string {
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
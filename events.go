@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// GradeEvent is sent to event streams when a student submits an
+// attempt and again when the grader reports on it
+type GradeEvent struct {
+	// Type is one of {submitted, graded}
+	Type       string
+	Course     string
+	Student    string
+	Assignment int64
+	Name       string
+	Submission int
+	TimeStamp  time.Time
+	Passed     bool
+	Listing    *AssignmentListing
+}
+
+// an eventStream receives the events for one student, or for every
+// student in a course if Student is blank
+type eventStream struct {
+	Course  string
+	Student string
+	Events  chan *GradeEvent
+}
+
+const eventStreamBuffer = 32
+const eventStreamKeepAlive = 30 * time.Second
+
+var eventStreams = make(map[*eventStream]bool)
+var eventStreamsMutex sync.Mutex
+
+func openEventStream(course, student string) *eventStream {
+	stream := &eventStream{
+		Course:  course,
+		Student: student,
+		Events:  make(chan *GradeEvent, eventStreamBuffer),
+	}
+	eventStreamsMutex.Lock()
+	eventStreams[stream] = true
+	eventStreamsMutex.Unlock()
+	return stream
+}
+
+func closeEventStream(stream *eventStream) {
+	eventStreamsMutex.Lock()
+	delete(eventStreams, stream)
+	eventStreamsMutex.Unlock()
+}
+
+// publishGradeEvent reports on a submission to every stream that is
+// watching it. The caller must be allowed to read the submission.
+// Events for a client that is not keeping up are dropped; the client
+// can catch up by polling as usual.
+func publishGradeEvent(kind string, sub *SubmissionDB) {
+	solution := sub.Solution
+	n := len(solution.SubmissionsInOrder) - 1
+	for n >= 0 && solution.SubmissionsInOrder[n] != sub {
+		n--
+	}
+	event := &GradeEvent{
+		Type:       kind,
+		Course:     solution.Assignment.Course.Tag,
+		Student:    solution.Student.Email,
+		Assignment: solution.Assignment.ID,
+		Name:       solution.Assignment.Problem.Name,
+		Submission: n,
+		TimeStamp:  sub.TimeStamp,
+		Passed:     sub.Passed,
+		Listing:    getAssignmentListing(solution.Assignment, solution.Student),
+	}
+
+	eventStreamsMutex.Lock()
+	defer eventStreamsMutex.Unlock()
+
+	for stream, _ := range eventStreams {
+		if stream.Course != "" && stream.Course != event.Course {
+			continue
+		}
+		if stream.Student != "" && stream.Student != event.Student {
+			continue
+		}
+		select {
+		case stream.Events <- event:
+		default:
+			log.Printf("Event stream for %s %s is full; dropping event", stream.Course, stream.Student)
+		}
+	}
+}
+
+// serveEventStream sends events to the client as server-sent events
+// until the client goes away
+func serveEventStream(w http.ResponseWriter, r *http.Request, stream *eventStream) {
+	defer closeEventStream(stream)
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		log.Printf("Streaming not supported by response writer")
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(eventStreamKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case event := <-stream.Events:
+			raw, err := json.Marshal(event)
+			if err != nil {
+				log.Printf("Error encoding event as JSON: %v", err)
+				continue
+			}
+			if _, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, raw); err != nil {
+				return
+			}
+
+		case <-keepAlive.C:
+			// a comment line keeps proxies from closing an idle stream
+			if _, err := fmt.Fprintf(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
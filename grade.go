@@ -1,13 +1,12 @@
 package main
 
 import (
-	"bytes"
 	"database/sql"
 	"encoding/json"
 	"fmt"
 	"log"
-	"net/http"
-	"net/url"
+	"sort"
+	"sync"
 	"time"
 )
 
@@ -18,74 +17,249 @@ type GradeItem struct {
 	Attempt     map[string]interface{}
 }
 
-var notifyGrader chan int64
-var gradeQueue = make(map[int64]bool)
+// GradeQueueEntry is a solution with ungraded submissions
+type GradeQueueEntry struct {
+	SolutionID int64
 
-func gradeDaemon() {
-	delay := time.Second
-	retry := true
-	for {
-		if !retry {
-			id := <-notifyGrader
-			gradeQueue[id] = true
-		}
+	// when the oldest ungraded submission was made
+	TimeStamp time.Time
 
-		// clear out the channel
-	clearLoop:
-		for {
-			select {
-			case id := <-notifyGrader:
-				gradeQueue[id] = true
-			default:
-				break clearLoop
-			}
+	// when the assignment closes for the student
+	Close time.Time
+
+	// the problem type tag, which decides which grader is needed
+	Type string
+
+	// failed attempts to grade the oldest ungraded submission, and
+	// when it may be tried again
+	Failures int
+	RetryAt  time.Time
+}
+
+// a submission that fails to grade is retried after gradeRetryDelay,
+// doubling each time, and marked failed after gradeMaxFailures
+const gradeRetryDelay = 5 * time.Second
+const gradeMaxFailures = 5
+
+// gradeQueue holds solutions with ungraded submissions by ID.
+// gradeInProgress holds the IDs of solutions claimed by a worker, so
+// that no solution is graded by two workers at once and submissions
+// within a solution are graded in order.
+//
+// The queue lives only in memory, but every entry corresponds to
+// Submission rows with no grade report, so it is rebuilt at startup.
+var gradeQueue = make(map[int64]*GradeQueueEntry)
+var gradeInProgress = make(map[int64]bool)
+var gradeQueueMutex sync.Mutex
+var gradeQueueReady = sync.NewCond(&gradeQueueMutex)
+
+// isUrgent is true if the assignment closes soon, which moves the
+// entry ahead of everything that is not urgent
+func (elt *GradeQueueEntry) isUrgent(now time.Time) bool {
+	window := time.Duration(config.GradePriorityMinutes) * time.Minute
+	return window > 0 && now.Before(elt.Close) && elt.Close.Sub(now) <= window
+}
+
+// grading order is urgent entries first, then oldest submission first
+func gradeBefore(a, b *GradeQueueEntry, now time.Time) bool {
+	if a.isUrgent(now) != b.isUrgent(now) {
+		return a.isUrgent(now)
+	}
+	if !a.TimeStamp.Equal(b.TimeStamp) {
+		return a.TimeStamp.Before(b.TimeStamp)
+	}
+	return a.SolutionID < b.SolutionID
+}
+
+type GradeQueueInOrder struct {
+	Entries []*GradeQueueEntry
+	Now     time.Time
+}
+
+func (p GradeQueueInOrder) Len() int { return len(p.Entries) }
+func (p GradeQueueInOrder) Less(i, j int) bool {
+	return gradeBefore(p.Entries[i], p.Entries[j], p.Now)
+}
+func (p GradeQueueInOrder) Swap(i, j int) { p.Entries[i], p.Entries[j] = p.Entries[j], p.Entries[i] }
+
+// queueForGrading adds an ungraded submission to the queue. The caller
+// must be allowed to read the submission's solution.
+func queueForGrading(sub *SubmissionDB) {
+	solution := sub.Solution
+	closes := getClose(solution.Assignment, solution.Student)
+
+	gradeQueueMutex.Lock()
+	if elt, present := gradeQueue[solution.ID]; present {
+		// the older submission keeps its place
+		if sub.TimeStamp.Before(elt.TimeStamp) {
+			elt.TimeStamp = sub.TimeStamp
+		}
+		elt.Close = closes
+	} else {
+		gradeQueue[solution.ID] = &GradeQueueEntry{
+			SolutionID: solution.ID,
+			TimeStamp:  sub.TimeStamp,
+			Close:      closes,
+			Type:       solution.Assignment.Problem.Type.Tag,
 		}
+	}
+	gradeQueueMutex.Unlock()
 
-		err := gradeAll()
-		if err != nil {
-			log.Printf("gradeDaemon err: sleeping for %v", delay)
-			time.Sleep(delay)
+	gradeQueueReady.Signal()
+}
 
-			delay *= 2
-			if delay > time.Minute {
-				delay = time.Minute
-			}
+// advanceForGrading moves a solution's place in the queue to its next
+// ungraded submission
+func advanceForGrading(id int64, timestamp time.Time) {
+	gradeQueueMutex.Lock()
+	if elt, present := gradeQueue[id]; present {
+		elt.TimeStamp = timestamp
+		elt.Failures = 0
+		elt.RetryAt = time.Time{}
+	}
+	gradeQueueMutex.Unlock()
+}
+
+// retryForGrading holds a solution back after its oldest ungraded
+// submission failed to grade. It returns true if the submission has
+// failed too many times and should not be tried again.
+func retryForGrading(id int64) bool {
+	gradeQueueMutex.Lock()
+	elt, present := gradeQueue[id]
+	if !present {
+		gradeQueueMutex.Unlock()
+		return false
+	}
+	elt.Failures++
+	if elt.Failures >= gradeMaxFailures {
+		gradeQueueMutex.Unlock()
+		return true
+	}
+	failures := elt.Failures
+	delay := gradeRetryDelay << uint(failures-1)
+	elt.RetryAt = time.Now().Add(delay)
+	gradeQueueMutex.Unlock()
+
+	log.Printf("Solution %d failed to grade %d times, retrying in %v", id, failures, delay)
+	time.AfterFunc(delay, wakeGradeWorkers)
+	return false
+}
+
+func dequeueForGrading(id int64) {
+	gradeQueueMutex.Lock()
+	delete(gradeQueue, id)
+	gradeQueueMutex.Unlock()
+}
+
+// getGradeQueue returns a copy of the queue in grading order
+func getGradeQueue() []*GradeQueueEntry {
+	gradeQueueMutex.Lock()
+	defer gradeQueueMutex.Unlock()
+
+	order := GradeQueueInOrder{Now: time.Now()}
+	for _, elt := range gradeQueue {
+		cp := *elt
+		order.Entries = append(order.Entries, &cp)
+	}
+	sort.Sort(order)
+	return order.Entries
+}
+
+// wakeGradeWorkers lets waiting workers look at the queue again
+func wakeGradeWorkers() {
+	gradeQueueMutex.Lock()
+	gradeQueueReady.Broadcast()
+	gradeQueueMutex.Unlock()
+}
+
+// claimForGrading waits until a queued solution is not being graded
+// by another worker, is not waiting to retry, and has a healthy grader
+// for its problem type, then claims the first one in grading order.
+// Solutions that are held back wait without holding up the rest of
+// the queue.
+func claimForGrading() int64 {
+	gradeQueueMutex.Lock()
+	defer gradeQueueMutex.Unlock()
 
-			retry = true
-		} else {
-			delay = time.Second
-			retry = false
+	for {
+		now := time.Now()
+		var best *GradeQueueEntry
+		for id, elt := range gradeQueue {
+			if gradeInProgress[id] || now.Before(elt.RetryAt) || (best != nil && !gradeBefore(elt, best, now)) {
+				continue
+			}
+			if graderAvailable(elt.Type) {
+				best = elt
+			}
 		}
+		if best != nil {
+			gradeInProgress[best.SolutionID] = true
+			return best.SolutionID
+		}
+		gradeQueueReady.Wait()
 	}
 }
 
-func gradeAll() (err error) {
-	didwork := true
-	for didwork && err == nil {
-		didwork, err = gradeOne(database)
+func releaseForGrading(id int64) {
+	gradeQueueMutex.Lock()
+	delete(gradeInProgress, id)
+	gradeQueueMutex.Unlock()
+
+	// the solution may still be queued for another worker
+	gradeQueueReady.Signal()
+}
+
+func startGradeWorkers() {
+	workers := config.GraderWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	log.Printf("Starting %d grading workers", workers)
+	for i := 0; i < workers; i++ {
+		go gradeWorker()
 	}
-	return
 }
 
-func gradeOne(db *sql.DB) (bool, error) {
-	if len(gradeQueue) == 0 {
-		return false, nil
+// gradeWorker grades one solution at a time. When a grader is down, the
+// grader backs off (see gradingFailed) so every worker holds off on it
+// together, and when one submission fails only its solution waits (see
+// retryForGrading). The short pause here only keeps a worker from
+// spinning on other errors.
+func gradeWorker() {
+	for {
+		id := claimForGrading()
+		err := gradeOne(database, id)
+		releaseForGrading(id)
+
+		if err != nil {
+			log.Printf("gradeWorker err: %v", err)
+			time.Sleep(time.Second)
+		}
 	}
+}
 
-	// get an item to grade
-	var id int64
-	for id, _ = range gradeQueue {
-		break
+// firstUngraded finds the index of the first submission without a
+// grade report, or -1 if all are graded. New submissions are always
+// ungraded, but a regrade can clear the report of any submission.
+func firstUngraded(solution *SolutionDB) int {
+	for i, sub := range solution.SubmissionsInOrder {
+		if len(sub.GradeReport) == 0 {
+			return i
+		}
 	}
+	return -1
+}
 
+// gradeOne grades the first ungraded submission of a solution
+func gradeOne(db *sql.DB, id int64) error {
 	// get a read lock to retrieve the submission data
 	mutex.RLock()
 	solution, present := solutionsByID[id]
 	if !present {
 		log.Printf("gradeOne: no solution found with ID %d", id)
-		delete(gradeQueue, id)
+		dequeueForGrading(id)
 		mutex.RUnlock()
-		return false, fmt.Errorf("no solution found with given ID")
+		return fmt.Errorf("no solution found with given ID")
 	}
 
 	// get the problem type
@@ -94,17 +268,11 @@ func gradeOne(db *sql.DB) (bool, error) {
 	problemType := problem.Type
 
 	// find the first ungraded submission
-	var i int
-	for i = len(solution.SubmissionsInOrder) - 1; i >= 0; i-- {
-		if len(solution.SubmissionsInOrder[i].GradeReport) > 0 {
-			break
-		}
-	}
-	i++
-	if i >= len(solution.SubmissionsInOrder) {
-		delete(gradeQueue, id)
+	i := firstUngraded(solution)
+	if i < 0 {
+		dequeueForGrading(id)
 		mutex.RUnlock()
-		return false, fmt.Errorf("No ungraded submissions")
+		return fmt.Errorf("No ungraded submissions")
 	}
 	attempt := solution.SubmissionsInOrder[i]
 
@@ -112,169 +280,279 @@ func gradeOne(db *sql.DB) (bool, error) {
 		id, i+1, len(solution.SubmissionsInOrder), problem.Type.Tag, solution.Student.Email)
 
 	// merge the fields into a single submission record
-	merged := make(map[string]interface{})
-
-	for _, field := range problemType.FieldList {
-		if value, present := attempt.Submission[field.Name]; present && field.Grader == "view" {
-			merged[field.Name] = value
-		} else if value, present := problem.Data[field.Name]; present && field.Grader == "view" {
-			merged[field.Name] = value
-		}
-	}
-
-	// form the request json
-	requestBody, err := json.Marshal(merged)
-	if err != nil {
-		log.Printf("gradeOne: error marshalling data for grader: %v", err)
-		delete(gradeQueue, id)
-		mutex.RUnlock()
-		return false, err
-	}
+	merged := mergeForGrader(problem, attempt.Submission)
 
 	// release the read mutex
 	mutex.RUnlock()
 
 	// send it to the grader
-	u := &url.URL{
-		Scheme: "http",
-		Host:   config.GraderAddress,
-		Path:   "/grade/" + problemType.Tag,
-	}
-	request, err := http.NewRequest("POST", u.String(), bytes.NewReader(requestBody))
-	if err != nil {
-		log.Printf("gradeOne: error creating request object: %v", err)
-		delete(gradeQueue, id)
-		return false, err
-	}
-	request.Header.Add("Content-Type", "application/json")
-	request.Header.Add("Accept", "application/json")
-	resp, err := http.DefaultClient.Do(request)
+	grader, err := graderFor(problemType.Tag)
 	if err != nil {
-		log.Printf("gradeOne: error sending request to %s: %v", u.String(), err)
-		return false, err
+		return err
 	}
-	if resp.StatusCode != 200 {
-		log.Printf("gradeOne: error result from request to %s: %s", u.String(), resp.Status)
-		return false, err
+	run := &GradingRunDB{
+		Started:     time.Now().In(timeZone),
+		Grader:      grader.Address,
+		GradeReport: make(map[string]interface{}),
 	}
-	defer resp.Body.Close()
-
-	// decode the response
 	report := make(map[string]interface{})
-
-	if err = json.NewDecoder(resp.Body).Decode(&report); err != nil {
-		log.Printf("gradeOne: failed to decode response from %s: %v", u.String(), err)
-		return false, err
+	err = grader.Do("POST", "/grade/"+problemType.Tag, merged, &report)
+	run.Duration = time.Since(run.Started)
+	if err == errGraderUnavailable {
+		// the grader was never asked, so there is nothing to record
+		return err
 	}
-	if len(report) == 0 {
-		log.Printf("gradeOne: response list from %s is emtpy", u.String())
-		return false, fmt.Errorf("Empty grader report")
-	}
-	if _, present = report["Passed"]; !present {
-		log.Printf("gradeOne: response is missing Passed field")
-		return false, fmt.Errorf("Missing Passed field")
+	if err == nil {
+		err = checkGradeReport(report)
 	}
-
-	// re-encode the response
-	graderReportJson, err := json.Marshal(report)
 	if err != nil {
-		log.Printf("gradeOne: JSON error encoding grade report: %v", err)
-		return false, fmt.Errorf("JSON error encoding grade report")
+		log.Printf("gradeOne: grading failed: %v", err)
+		run.Error = err.Error()
+		if graderDown(err) {
+			// the grader is in trouble, so everything it serves waits
+			grader.gradingFailed()
+			recordFailedGradingRun(db, attempt, run)
+			return err
+		}
+
+		// the trouble is with this submission, so only it waits
+		if !retryForGrading(id) {
+			recordFailedGradingRun(db, attempt, run)
+			return err
+		}
+
+		// give up and mark it failed so later submissions are graded
+		log.Printf("gradeOne: giving up on solution %d after %d failures", id, gradeMaxFailures)
+		report = map[string]interface{}{
+			"Passed": false,
+			"Error":  "Grading failed: " + err.Error(),
+		}
+	} else {
+		grader.gradingSucceeded()
+	}
+	run.GradeReport = report
+	run.Passed = report["Passed"].(bool)
+	score, maxScore := getScore(report)
+	if version, ok := report["Version"].(string); ok {
+		run.Version = version
 	}
 
 	// record the response
-	mutex.Lock()
-	defer mutex.Unlock()
+	writeMutex.Lock()
+	defer writeMutex.Unlock()
 
-	solution = solutionsByID[id]
+	if solution, present = solutionsByID[id]; !present {
+		log.Printf("gradeOne: solution %d removed during grading", id)
+		dequeueForGrading(id)
+		return fmt.Errorf("Solution removed during grading")
+	}
 	if i >= len(solution.SubmissionsInOrder) || len(solution.SubmissionsInOrder[i].GradeReport) > 0 {
 		log.Printf("gradeOne: submission changed during grading for %d", id)
-		return false, fmt.Errorf("Submission change during grading")
+		return fmt.Errorf("Submission change during grading")
 	}
 	sub := solution.SubmissionsInOrder[i]
-	passed := false
 
-	switch t := report["Passed"].(type) {
-	case bool:
-		passed = t
-	default:
-		log.Printf("gradeOne: Passed field of wrong type %t", t)
-		return false, fmt.Errorf("Passed field of wrong type")
+	// write to database first
+	txn, err := db.Begin()
+	if err != nil {
+		log.Printf("gradeOne: DB error starting transaction: %v", err)
+		return err
 	}
+	defer txn.Rollback()
 
-	// write to database first
-	_, err = database.Exec("update Submission set GradeReport = ?, Passed = ? where Solution = ? and TimeStamp = ?",
-		graderReportJson, passed, sub.Solution.ID, sub.TimeStamp)
+	if err = insertGradingRun(txn, sub, run); err != nil {
+		log.Printf("gradeOne: DB error writing grading run: %v", err)
+		return err
+	}
+	_, err = txn.Exec("update Submission set GradeReport = ?, Passed = ?, Score = ?, MaxScore = ? where Solution = ? and TimeStamp = ?",
+		encodeGradeReport(report), run.Passed, score, maxScore, sub.Solution.ID, sub.TimeStamp)
 	if err != nil {
 		log.Printf("gradeOne: DB error writing result: %v", err)
-		return false, err
+		return err
 	}
+	if err = txn.Commit(); err != nil {
+		log.Printf("gradeOne: DB error committing: %v", err)
+		return err
+	}
+
+	mutex.Lock()
 	sub.GradeReport = report
-	sub.Passed = passed
+	sub.Passed = run.Passed
+	sub.Score = score
+	sub.MaxScore = maxScore
+	sub.GradingRuns = append(sub.GradingRuns, run)
+	mutex.Unlock()
+
+	publishGradeEvent("graded", sub)
 
 	// remove this solution from the queue?
-	if i == len(solution.SubmissionsInOrder)-1 {
-		delete(gradeQueue, id)
+	if next := firstUngraded(solution); next < 0 {
+		dequeueForGrading(id)
+	} else {
+		advanceForGrading(id, solution.SubmissionsInOrder[next].TimeStamp)
 	}
 
-	return true, nil
+	return nil
 }
 
-func getOutput(problem *ProblemDB) (interface{}, error) {
-	// check the cache
-	if result, present := outputByProblemID[problem.ID]; present {
-		return result, nil
-	}
+// mergeForGrader combines a student's attempt with the problem data,
+// keeping only the fields the grader should see. The attempt wins if
+// both have a value for a field.
+func mergeForGrader(problem *ProblemDB, attempt map[string]interface{}) map[string]interface{} {
+	merged := make(map[string]interface{})
 
-	// get the appropriate fields
-	data := make(map[string]interface{})
 	for _, field := range problem.Type.FieldList {
-		if value, present := problem.Data[field.Name]; present && field.Grader == "view" {
-			data[field.Name] = value
+		if value, present := attempt[field.Name]; present && field.Grader == "view" {
+			merged[field.Name] = value
+		} else if value, present := problem.Data[field.Name]; present && field.Grader == "view" {
+			merged[field.Name] = value
 		}
 	}
 
-	// form the request json
-	requestBody, err := json.Marshal(data)
-	if err != nil {
-		log.Printf("getOutput: error marshalling data for grader: %v", err)
-		return nil, err
+	return merged
+}
+
+// checkGradeReport makes sure a grader response has a pass/fail result
+func checkGradeReport(report map[string]interface{}) error {
+	if len(report) == 0 {
+		log.Printf("gradeOne: response from grader is empty")
+		return fmt.Errorf("Empty grader report")
+	}
+	switch t := report["Passed"].(type) {
+	case bool:
+		return nil
+	case nil:
+		log.Printf("gradeOne: response is missing Passed field")
+		return fmt.Errorf("Missing Passed field")
+	default:
+		log.Printf("gradeOne: Passed field of wrong type %T", t)
+		return fmt.Errorf("Passed field of wrong type")
 	}
+}
 
-	// send it to the grader
-	u := &url.URL{
-		Scheme: "http",
-		Host:   config.GraderAddress,
-		Path:   "/output/" + problem.Type.Tag,
+// getScore finds the optional partial credit score in a grade report.
+// Graders that give one report how many test cases passed as Score out
+// of MaxScore. A missing or invalid score is returned as 0 out of 0.
+func getScore(report map[string]interface{}) (score, maxScore float64) {
+	score, ok1 := report["Score"].(float64)
+	maxScore, ok2 := report["MaxScore"].(float64)
+	if !ok1 && !ok2 {
+		return 0, 0
+	}
+	if !ok1 || !ok2 || maxScore <= 0 || score < 0 || score > maxScore {
+		log.Printf("gradeOne: ignoring invalid score %v out of %v", report["Score"], report["MaxScore"])
+		return 0, 0
 	}
-	request, err := http.NewRequest("POST", u.String(), bytes.NewReader(requestBody))
+	return score, maxScore
+}
+
+// encodeGradeReport re-encodes a report for storage. Reports were
+// decoded from JSON, so they can always be encoded again.
+func encodeGradeReport(report map[string]interface{}) string {
+	if len(report) == 0 {
+		return ""
+	}
+	raw, err := json.Marshal(report)
 	if err != nil {
-		log.Printf("getOutput: error creating request object: %v", err)
-		return nil, err
+		log.Printf("JSON error encoding grade report: %v", err)
+		return ""
 	}
-	request.Header.Add("Content-Type", "application/json")
-	request.Header.Add("Accept", "application/json")
-	resp, err := http.DefaultClient.Do(request)
+	return string(raw)
+}
+
+func insertGradingRun(txn *sql.Tx, sub *SubmissionDB, run *GradingRunDB) error {
+	_, err := txn.Exec("insert into GradingRun values (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		sub.Solution.ID,
+		sub.TimeStamp,
+		run.Started,
+		int64(run.Duration/time.Millisecond),
+		run.Grader,
+		run.Version,
+		encodeGradeReport(run.GradeReport),
+		run.Passed,
+		run.Error)
+	return err
+}
+
+// recordFailedGradingRun saves a grading attempt that did not produce
+// a grade report, so flaky graders show up in the history
+func recordFailedGradingRun(db *sql.DB, sub *SubmissionDB, run *GradingRunDB) {
+	writeMutex.Lock()
+	defer writeMutex.Unlock()
+
+	txn, err := db.Begin()
 	if err != nil {
-		log.Printf("getOutput: error sending request to %s: %v", u.String(), err)
-		return nil, err
+		log.Printf("gradeOne: DB error starting transaction: %v", err)
+		return
+	}
+	defer txn.Rollback()
+
+	if err = insertGradingRun(txn, sub, run); err != nil {
+		log.Printf("gradeOne: DB error writing grading run: %v", err)
+		return
+	}
+	if err = txn.Commit(); err != nil {
+		log.Printf("gradeOne: DB error committing: %v", err)
+		return
+	}
+
+	mutex.Lock()
+	sub.GradingRuns = append(sub.GradingRuns, run)
+	mutex.Unlock()
+}
+
+// OutputRequest is a copy of what a grader needs to find a problem's
+// expected output, so the request can be sent without holding the lock
+type OutputRequest struct {
+	ProblemID int64
+	Type      string
+	Data      map[string]interface{}
+}
+
+// newOutputRequest copies the problem fields the grader should see.
+// The caller must hold the read lock.
+func newOutputRequest(problem *ProblemDB) *OutputRequest {
+	return &OutputRequest{
+		ProblemID: problem.ID,
+		Type:      problem.Type.Tag,
+		Data:      mergeForGrader(problem, nil),
 	}
-	if resp.StatusCode != 200 {
-		log.Printf("getOutput: error result from request to %s: %s", u.String(), resp.Status)
+}
+
+// getOutput asks a grader for a problem's expected output. Results are
+// cached along with the data they came from, so a request copied
+// before the problem changed never returns (or caches) stale output.
+func getOutput(req *OutputRequest) (interface{}, error) {
+	raw, err := json.Marshal(req.Data)
+	if err != nil {
+		log.Printf("getOutput: error marshalling data for grader: %v", err)
 		return nil, err
 	}
-	defer resp.Body.Close()
+	key := string(raw)
 
-	// decode the response
-	report := make(map[string]interface{})
+	// check the cache
+	outputMutex.Lock()
+	cached, present := outputByProblemID[req.ProblemID]
+	outputMutex.Unlock()
+	if present && cached.Data == key {
+		return cached.Output, nil
+	}
 
-	if err = json.NewDecoder(resp.Body).Decode(&report); err != nil {
-		log.Printf("getOutput: failed to decode response from %s: %v", u.String(), err)
+	// send it to the grader
+	grader, err := graderFor(req.Type)
+	if err != nil {
+		return nil, err
+	}
+	report := make(map[string]interface{})
+	if err := grader.Do("POST", "/output/"+req.Type, req.Data, &report); err != nil {
+		log.Printf("getOutput: request failed: %v", err)
 		return nil, err
 	}
 
 	if result, present := report["Output"]; present {
-		outputByProblemID[problem.ID] = result
+		outputMutex.Lock()
+		outputByProblemID[req.ProblemID] = &CachedOutput{Data: key, Output: result}
+		outputMutex.Unlock()
 		return result, nil
 	}
 
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// gradebookFormat picks the format for a course grade report from the
+// format query parameter, or from the Accept header if it is missing.
+// One of {json, csv, canvas, moodle}.
+func gradebookFormat(r *http.Request) string {
+	format := strings.ToLower(r.URL.Query().Get("format"))
+	if format == "" && strings.Contains(r.Header.Get("Accept"), "text/csv") {
+		format = "csv"
+	}
+	if format == "" {
+		format = "json"
+	}
+	return format
+}
+
+// gradebookColumns lists the assignments in a course that have opened,
+// in order of close time
+func gradebookColumns(course *CourseDB) []*AssignmentListing {
+	now := time.Now().In(timeZone)
+	columns := []*AssignmentListing{}
+	for _, asst := range course.Assignments {
+		if now.Before(asst.Open) {
+			continue
+		}
+		columns = append(columns, getAssignmentListing(asst, nil))
+	}
+	sort.Sort(AssignmentsByClose(columns))
+	return columns
+}
+
+// gradebookListings maps assignment IDs to a student's listings
+func gradebookListings(elt *CourseGradesResponseElt) map[int64]*AssignmentListing {
+	listings := make(map[int64]*AssignmentListing)
+	for _, listing := range elt.Assignments {
+		listings[listing.ID] = listing
+	}
+	return listings
+}
+
+// gradebookCsv has one row per student and one column per assignment
+// giving the percentage of credit earned, followed by totals. Only
+// assignments for credit count toward the totals, and points are
+// weighted.
+func gradebookCsv(course *CourseDB, students []*CourseGradesResponseElt) [][]string {
+	columns := gradebookColumns(course)
+	header := []string{"Name", "Email"}
+	for _, column := range columns {
+		header = append(header, fmt.Sprintf("%s (%d)", column.Name, column.ID))
+	}
+	header = append(header, "Passed", "Late", "Attempts", "Points", "Possible", "Total")
+	rows := [][]string{header}
+
+	for _, elt := range students {
+		listings := gradebookListings(elt)
+		row := []string{elt.Name, elt.Email}
+		passed, late, attempts := 0, 0, 0
+		for _, column := range columns {
+			listing := listings[column.ID]
+			row = append(row, strconv.Itoa(listing.Credit))
+			if !listing.ForCredit {
+				continue
+			}
+			if listing.Passed {
+				passed++
+				if listing.Late {
+					late++
+				}
+			}
+			attempts += listing.Attempts
+		}
+		total := ""
+		if elt.Possible > 0 {
+			total = fmt.Sprintf("%.1f", elt.Total)
+		}
+		row = append(row,
+			strconv.Itoa(passed),
+			strconv.Itoa(late),
+			strconv.Itoa(attempts),
+			formatPoints(elt.Points),
+			formatPoints(elt.Possible),
+			total)
+		rows = append(rows, row)
+	}
+
+	return rows
+}
+
+// gradebookCanvas is in the format of a Canvas gradebook export, which
+// Canvas accepts for import. SIS User ID is the student ID from the
+// roster and SIS Login ID is the email address. Canvas matches
+// students on SIS User ID, and falls back to SIS Login ID for students
+// with no student ID. Only assignments for credit are included, worth
+// 100 points times their weights.
+func gradebookCanvas(course *CourseDB, students []*CourseGradesResponseElt) [][]string {
+	columns := gradebookForCredit(course)
+	header := []string{"Student", "ID", "SIS User ID", "SIS Login ID", "Section"}
+	possible := []string{"    Points Possible", "", "", "", ""}
+	for _, column := range columns {
+		header = append(header, column.Name)
+		possible = append(possible, formatPoints(100*column.Weight))
+	}
+	rows := [][]string{header, possible}
+
+	for _, elt := range students {
+		listings := gradebookListings(elt)
+		row := []string{elt.Name, "", elt.StudentID, elt.Email, course.Tag}
+		for _, column := range columns {
+			row = append(row, formatPoints(float64(listings[column.ID].Credit)*column.Weight))
+		}
+		rows = append(rows, row)
+	}
+
+	return rows
+}
+
+// gradebookMoodle is in the form expected by the Moodle CSV grade
+// import, with students matched by email address. Only assignments for
+// credit are included, worth 100 points times their weights.
+func gradebookMoodle(course *CourseDB, students []*CourseGradesResponseElt) [][]string {
+	columns := gradebookForCredit(course)
+	header := []string{"First name", "Surname", "Email address"}
+	for _, column := range columns {
+		header = append(header, column.Name+" (Real)")
+	}
+	rows := [][]string{header}
+
+	for _, elt := range students {
+		listings := gradebookListings(elt)
+		first, last := elt.Name, ""
+		if i := strings.LastIndex(elt.Name, " "); i >= 0 {
+			first, last = elt.Name[:i], elt.Name[i+1:]
+		}
+		row := []string{first, last, elt.Email}
+		for _, column := range columns {
+			row = append(row, fmt.Sprintf("%.2f", float64(listings[column.ID].Credit)*column.Weight))
+		}
+		rows = append(rows, row)
+	}
+
+	return rows
+}
+
+func gradebookForCredit(course *CourseDB) []*AssignmentListing {
+	columns := []*AssignmentListing{}
+	for _, column := range gradebookColumns(course) {
+		if column.ForCredit {
+			columns = append(columns, column)
+		}
+	}
+	return columns
+}
+
+func formatPoints(points float64) string {
+	return strconv.FormatFloat(points, 'f', -1, 64)
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// GraderClient sends requests to a grader with a timeout, and acts as a
+// circuit breaker: after several failures in a row the grader is marked
+// unhealthy and requests fail immediately until a health probe of /list
+// succeeds or the cooldown passes and a trial request gets through.
+type GraderClient struct {
+	Address string
+	client  *http.Client
+
+	mutex     sync.Mutex
+	healthy   bool
+	failures  int
+	openUntil time.Time
+
+	// grading backs off after a failed grade, shared by all workers
+	backoff time.Duration
+	retryAt time.Time
+}
+
+const graderFailureThreshold = 3
+const graderCooldown = 30 * time.Second
+const graderMinBackoff = time.Second
+const graderMaxBackoff = time.Minute
+
+var errGraderUnavailable = fmt.Errorf("Grader is unavailable")
+
+// graderStatusError is an error status from a grader that answered
+type graderStatusError struct {
+	Code   int
+	Status string
+}
+
+func (e *graderStatusError) Error() string {
+	return "Grader returned " + e.Status
+}
+
+// graderDown is true if an error means the grader itself is in
+// trouble: it could not be reached, or it failed with a 5xx status.
+// A 4xx status or a bad response body is a problem with one request,
+// so it does not count against the grader.
+func graderDown(err error) bool {
+	switch e := err.(type) {
+	case *url.Error:
+		return true
+	case *graderStatusError:
+		return e.Code >= 500
+	}
+	return false
+}
+
+// graders lists every grader backend. Each one advertises the problem
+// types it serves through /list, and gradersByType[tag] lists the
+// replicas that serve a type. Requests are spread across healthy
+// replicas in turn.
+var graders []*GraderClient
+var gradersByType = make(map[string][]*GraderClient)
+var nextGraderByType = make(map[string]int)
+var gradersMutex sync.Mutex
+
+// graderFor picks a grader for a problem type, preferring healthy ones
+func graderFor(tag string) (*GraderClient, error) {
+	gradersMutex.Lock()
+	defer gradersMutex.Unlock()
+
+	list := gradersByType[tag]
+	if len(list) == 0 {
+		log.Printf("No grader serves problem type %s", tag)
+		return nil, fmt.Errorf("No grader for problem type %s", tag)
+	}
+
+	start := nextGraderByType[tag]
+	for i := 0; i < len(list); i++ {
+		n := (start + i) % len(list)
+		if list[n].Healthy() {
+			nextGraderByType[tag] = (n + 1) % len(list)
+			return list[n], nil
+		}
+	}
+
+	// none are healthy, so let the circuit breaker decide
+	nextGraderByType[tag] = (start + 1) % len(list)
+	return list[start%len(list)], nil
+}
+
+// graderAvailable is true if a healthy grader that is not backing off
+// serves the problem type
+func graderAvailable(tag string) bool {
+	gradersMutex.Lock()
+	defer gradersMutex.Unlock()
+
+	now := time.Now()
+	for _, g := range gradersByType[tag] {
+		if g.readyToGrade(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// gradersHealthy is true if every grader is healthy
+func gradersHealthy() bool {
+	for _, g := range graders {
+		if !g.Healthy() {
+			return false
+		}
+	}
+	return true
+}
+
+func newGraderClient(address string) *GraderClient {
+	timeout := time.Duration(config.GraderTimeoutSeconds) * time.Second
+	if timeout <= 0 {
+		timeout = time.Minute
+	}
+	return &GraderClient{
+		Address: address,
+		client:  &http.Client{Timeout: timeout},
+		healthy: true,
+	}
+}
+
+// Do sends a request to the grader with the given value encoded as a
+// JSON body (if not nil), and decodes the JSON response into result.
+// Only errors that mean the grader is down count toward the breaker.
+func (g *GraderClient) Do(method, path string, body interface{}, result interface{}) error {
+	if !g.available() {
+		return errGraderUnavailable
+	}
+	err := g.do(method, path, body, result)
+	if err != nil && graderDown(err) {
+		g.failed(err)
+	} else {
+		g.succeeded()
+	}
+	return err
+}
+
+func (g *GraderClient) do(method, path string, body interface{}, result interface{}) error {
+	u := &url.URL{
+		Scheme: "http",
+		Host:   g.Address,
+		Path:   path,
+	}
+
+	var requestBody io.Reader
+	if body != nil {
+		raw, err := json.Marshal(body)
+		if err != nil {
+			log.Printf("GraderClient: error marshalling data for %s: %v", u.String(), err)
+			return err
+		}
+		requestBody = bytes.NewReader(raw)
+	}
+	request, err := http.NewRequest(method, u.String(), requestBody)
+	if err != nil {
+		log.Printf("GraderClient: error creating request object: %v", err)
+		return err
+	}
+	if body != nil {
+		request.Header.Add("Content-Type", "application/json")
+	}
+	request.Header.Add("Accept", "application/json")
+
+	resp, err := g.client.Do(request)
+	if err != nil {
+		log.Printf("GraderClient: error sending request to %s: %v", u.String(), err)
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		log.Printf("GraderClient: error result from request to %s: %s", u.String(), resp.Status)
+		return &graderStatusError{Code: resp.StatusCode, Status: resp.Status}
+	}
+
+	if err = json.NewDecoder(resp.Body).Decode(result); err != nil {
+		log.Printf("GraderClient: failed to decode response from %s: %v", u.String(), err)
+		return err
+	}
+	return nil
+}
+
+// available is true if the grader is healthy, or if it is unhealthy but
+// the cooldown has passed and a trial request should be let through
+func (g *GraderClient) available() bool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if g.healthy {
+		return true
+	}
+	if time.Now().After(g.openUntil) {
+		// let one request through, and hold the rest until it finishes
+		g.openUntil = time.Now().Add(g.client.Timeout)
+		return true
+	}
+	return false
+}
+
+func (g *GraderClient) Healthy() bool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	return g.healthy
+}
+
+// readyToGrade is true if the grader is healthy and not backing off
+// after a failed grade
+func (g *GraderClient) readyToGrade(now time.Time) bool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	return g.healthy && !now.Before(g.retryAt)
+}
+
+// gradingFailed doubles the grader's backoff. Workers leave its
+// solutions in the queue until the backoff passes.
+func (g *GraderClient) gradingFailed() {
+	g.mutex.Lock()
+	g.backoff *= 2
+	if g.backoff < graderMinBackoff {
+		g.backoff = graderMinBackoff
+	}
+	if g.backoff > graderMaxBackoff {
+		g.backoff = graderMaxBackoff
+	}
+	delay := g.backoff
+	g.retryAt = time.Now().Add(delay)
+	g.mutex.Unlock()
+
+	log.Printf("Grader at %s: grading backs off for %v", g.Address, delay)
+	time.AfterFunc(delay, wakeGradeWorkers)
+}
+
+func (g *GraderClient) gradingSucceeded() {
+	g.mutex.Lock()
+	g.backoff = 0
+	g.retryAt = time.Time{}
+	g.mutex.Unlock()
+}
+
+func (g *GraderClient) failed(err error) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	g.failures++
+	if g.healthy && g.failures >= graderFailureThreshold {
+		log.Printf("Grader at %s marked unhealthy after %d failures: %v", g.Address, g.failures, err)
+		g.healthy = false
+	}
+	if !g.healthy {
+		g.openUntil = time.Now().Add(graderCooldown)
+	}
+}
+
+func (g *GraderClient) succeeded() {
+	g.mutex.Lock()
+	recovered := !g.healthy
+	g.healthy = true
+	g.failures = 0
+	g.mutex.Unlock()
+
+	if recovered {
+		log.Printf("Grader at %s is healthy again", g.Address)
+
+		// work for this grader may have been held back
+		wakeGradeWorkers()
+	}
+}
+
+// monitor probes the grader's /list endpoint periodically. The probe
+// skips the circuit breaker, so it is how an unhealthy grader recovers.
+func (g *GraderClient) monitor() {
+	interval := time.Duration(config.GraderHealthSeconds) * time.Second
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+	for {
+		time.Sleep(interval)
+
+		var list []*ProblemType
+		if err := g.do("GET", "/list", nil, &list); err != nil {
+			g.failed(err)
+		} else {
+			g.succeeded()
+		}
+	}
+}
@@ -12,8 +12,7 @@ jQuery(function ($) {
               Email: '',
               Role: '',
               Expires: 0,
-              LoggedIn: false,
-              LoginMethod: 'google'
+              LoggedIn: false
         };
         var n = Number($.cookie('codrilla-expires'));
         CODRILLA.Expires = new Date(n * 1000);
@@ -31,75 +30,39 @@ jQuery(function ($) {
 
     getCookies();
 
-    // login handling
-    if (CODRILLA.LoginMethod == 'persona') {
-        navigator.id.watch({
-            loggedInUser: CODRILLA.Email,
-            onlogin: function(assertion) {
-                $.ajax({
-                    type: 'POST',
-                    url: '/auth/login/browserid',
-                    dataType: 'json',
-                    data: { Assertion: assertion },
-                    success: function (res, status, xhr) {
-                        getCookies();
-                        setupLoggedIn();
-                    },
-                    error: function (res, status, xhr) {
-                        console.log('login failure');
-                        console.log(res);
-                        setupLoggedOut();
-                    }
-                });
-            },
-            onlogout: function() {
-                setupLoggedOut();
-                $.ajax({
-                    type: 'POST',
-                    url: '/auth/logout',
-                    success: function(res, status, xhr) {
-                        setupLoggedOut();
-                    },
-                    error: function(res, status, xhr) {
-                        console.log('logout failure');
-                        console.log(res);
-                        setupLoggedOut();
-                    }
-                });
-            } 
-        });
-    }
-    $('#persona-login-button').click(function () {
-        navigator.id.request();
-        return false;
+    // state-changing requests must echo the session's CSRF token
+    $.ajaxSetup({
+        beforeSend: function (xhr, settings) {
+            if (settings.type != 'GET')
+                xhr.setRequestHeader('X-CSRF-Token', $.cookie('codrilla-csrf'));
+        }
     });
-    $('#google-login-button').click(function () {
-        var url = 'https://accounts.google.com/o/oauth2/auth' +
-            '?response_type=code' +
-            '&client_id=854211025378.apps.googleusercontent.com' +
-            '&redirect_uri=http://' + window.location.host + '/auth/login/google' +
-            '&scope=https://www.googleapis.com/auth/userinfo.email';
-        var loginwindow = window.open(url, 'login');
-        if (window.focus) loginwindow.focus();
-        return false;
+
+    // login handling: one button for each login method the server offers
+    $.getJSON('/auth/providers', function (providers) {
+        var $buttons = $('#login-buttons').empty();
+        $.each(providers, function (i, name) {
+            var $p = $('<p />').appendTo($buttons);
+            $('<a href="#" />').text('Login with ' + name).appendTo($p).click(function () {
+                var loginwindow = window.open('/auth/login/' + encodeURIComponent(name), 'login');
+                if (window.focus) loginwindow.focus();
+                return false;
+            });
+        });
     });
     $('#logout-button').click(function () {
-        if (CODRILLA.LoginMethod == 'persona')
-            navigator.id.logout();
-        else {
-            $.ajax({
-                type: 'POST',
-                url: '/auth/logout',
-                success: function(res, status, xhr) {
-                    setupLoggedOut();
-                },
-                error: function(res, status, xhr) {
-                    console.log('logout failure');
-                    console.log(res);
-                    setupLoggedOut();
-                }
-            });
-        }
+        $.ajax({
+            type: 'POST',
+            url: '/auth/logout',
+            success: function(res, status, xhr) {
+                setupLoggedOut();
+            },
+            error: function(res, status, xhr) {
+                console.log('logout failure');
+                console.log(res);
+                setupLoggedOut();
+            }
+        });
         return false;
     });
 
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"compress/gzip"
 	"database/sql"
+	"encoding/csv"
 	"encoding/json"
 	"github.com/gorilla/sessions"
 	"io/ioutil"
@@ -24,15 +25,34 @@ type Config struct {
 	DatabaseName  string
 	LogFileName   string
 	GraderAddress string
+	GraderWorkers int
 
-	BrowserIDVerifyURL string
-	BrowserIDAudience  string
+	// additional graders; each one serves the problem types it lists
+	GraderAddresses []string
 
-	GoogleVerifyURL    string
-	GoogleGetEmailURL  string
-	GoogleClientID     string
-	GoogleClientSecret string
-	GoogleRedirectURI  string
+	// grader requests time out after this long (default 60)
+	GraderTimeoutSeconds int
+
+	// how often to check on the grader (default 30)
+	GraderHealthSeconds int
+
+	// copy of the grader's problem types, used if it is down at startup
+	ProblemTypeCacheFile string
+
+	// assignments closing within this many minutes are graded first
+	GradePriorityMinutes int
+
+	// re-fetch problem types from the graders this often (0 means never)
+	ProblemTypeRefreshMinutes int
+
+	// most submissions a student can make in a minute, counting all
+	// assignments (0 means no limit)
+	SubmissionsPerMinute int
+
+	// most test runs a student can start in a minute (0 means no limit)
+	TestRunsPerMinute int
+
+	AuthProviders []*AuthProviderConfig
 
 	StudentEmailDomain string
 }
@@ -70,6 +90,9 @@ func main() {
 	// set up session store
 	store = sessions.NewCookieStore([]byte(config.SessionSecret))
 
+	// set up login methods
+	setupAuthProviders()
+
 	// set up web server
 	http.Handle("/css/", http.StripPrefix("/css", http.FileServer(http.Dir("css"))))
 	http.Handle("/js/", http.StripPrefix("/js", http.FileServer(http.Dir("js"))))
@@ -83,14 +106,30 @@ func main() {
 	})
 
 	// load problem types
+	if config.ProblemTypeCacheFile == "" {
+		config.ProblemTypeCacheFile = "problemtypes.json"
+	}
+	for _, address := range append([]string{config.GraderAddress}, config.GraderAddresses...) {
+		if address != "" {
+			graders = append(graders, newGraderClient(address))
+		}
+	}
+	if len(graders) == 0 {
+		log.Fatalf("No grader addresses configured")
+	}
 	setupProblemTypes()
+	for _, g := range graders {
+		go g.monitor()
+	}
+	if config.ProblemTypeRefreshMinutes > 0 {
+		go refreshProblemTypesEvery(time.Duration(config.ProblemTypeRefreshMinutes) * time.Minute)
+	}
 
 	// connect to database
 	initDatabase()
 
 	// start grader
-	notifyGrader = make(chan int64, 100)
-	go gradeDaemon()
+	startGradeWorkers()
 
 	log.Printf("Listening on %s", config.Address)
 	if err = http.ListenAndServe(config.Address, nil); err != nil {
@@ -98,6 +137,9 @@ func main() {
 	}
 }
 
+// handlerNoAuth is for the login flow. It holds no lock, since logins
+// wait on the identity provider, so the handler must take the read
+// lock itself while it looks at the data.
 type handlerNoAuth func(http.ResponseWriter, *http.Request, *sessions.Session)
 
 func (h handlerNoAuth) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -106,10 +148,6 @@ func (h handlerNoAuth) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// get the session (or create a new one)
 	session, _ := store.Get(r, "codrilla-session")
 
-	// get a read lock
-	mutex.RLock()
-	defer mutex.RUnlock()
-
 	// call the handler
 	h(w, r, session)
 }
@@ -151,6 +189,50 @@ func (h handlerInstructor) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	h(w, r, instructor)
 }
 
+// handlerInstructorStream is like handlerStudentStream for instructors
+type handlerInstructorStream func(http.ResponseWriter, *http.Request, *InstructorDB) *eventStream
+
+func (h handlerInstructorStream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log.Printf("%s %s", r.Method, r.URL.Path)
+
+	// get the session (or create a new one)
+	session, _ := store.Get(r, "codrilla-session")
+
+	// get a read lock, but only while setting up the stream
+	mutex.RLock()
+
+	// verify that the user is logged in
+	email, err := checkSession(session)
+	if err != nil {
+		mutex.RUnlock()
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	instructor, present := instructorsByEmail[email]
+	if !present {
+		mutex.RUnlock()
+		log.Printf("InstructorDB not found: %s", email)
+		http.Error(w, "Instructor record not found", http.StatusNotFound)
+		return
+	}
+
+	// check that the user is logged in as an instructor or admin
+	if session.Values["role"] != "admin" && session.Values["role"] != "instructor" {
+		mutex.RUnlock()
+		log.Printf("Call to %s by non-instructor", r.URL.Path)
+		http.Error(w, "Must be logged in as an instructor", http.StatusForbidden)
+		return
+	}
+
+	stream := h(w, r, instructor)
+	mutex.RUnlock()
+
+	if stream != nil {
+		serveEventStream(w, r, stream)
+	}
+}
+
 type handlerInstructorJson func(http.ResponseWriter, *http.Request, *sql.DB, *InstructorDB, *json.Decoder)
 
 func (h handlerInstructorJson) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -159,9 +241,9 @@ func (h handlerInstructorJson) ServeHTTP(w http.ResponseWriter, r *http.Request)
 	// get the session (or create a new one)
 	session, _ := store.Get(r, "codrilla-session")
 
-	// get a read/write lock
-	mutex.Lock()
-	defer mutex.Unlock()
+	// get the writer lock; changes to memory take mutex as well
+	writeMutex.Lock()
+	defer writeMutex.Unlock()
 
 	// verify that the user is logged in
 	email, err := checkSession(session)
@@ -170,7 +252,7 @@ func (h handlerInstructorJson) ServeHTTP(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	if !checkJsonRequest(w, r) {
+	if !checkJsonRequest(w, r) || !checkCsrfToken(w, r, session) {
 		return
 	}
 
@@ -195,6 +277,48 @@ func (h handlerInstructorJson) ServeHTTP(w http.ResponseWriter, r *http.Request)
 	h(w, r, database, instructor, decoder)
 }
 
+// handlerInstructorUnlocked makes the same checks as handlerInstructor,
+// but holds no lock while the handler runs, so the handler must take
+// the read lock itself while it looks at the data. It is for requests
+// with slow work that can be done on a copy of the data.
+type handlerInstructorUnlocked func(http.ResponseWriter, *http.Request, *InstructorDB)
+
+func (h handlerInstructorUnlocked) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log.Printf("%s %s", r.Method, r.URL.Path)
+
+	// get the session (or create a new one)
+	session, _ := store.Get(r, "codrilla-session")
+
+	// get a read lock, but only while checking the user
+	mutex.RLock()
+
+	// verify that the user is logged in
+	email, err := checkSession(session)
+	if err != nil {
+		mutex.RUnlock()
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	instructor, present := instructorsByEmail[email]
+	mutex.RUnlock()
+	if !present {
+		log.Printf("InstructorDB not found: %s", email)
+		http.Error(w, "Instructor record not found", http.StatusNotFound)
+		return
+	}
+
+	// check that the user is logged in as an instructor or admin
+	if session.Values["role"] != "admin" && session.Values["role"] != "instructor" {
+		log.Printf("Call to %s by non-instructor", r.URL.Path)
+		http.Error(w, "Must be logged in as an instructor", http.StatusForbidden)
+		return
+	}
+
+	// call the handler
+	h(w, r, instructor)
+}
+
 type handlerStudent func(http.ResponseWriter, *http.Request, *StudentDB)
 
 func (h handlerStudent) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -224,6 +348,78 @@ func (h handlerStudent) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	h(w, r, student)
 }
 
+// handlerStudentUnlocked makes the same checks as handlerStudent, but
+// holds no lock while the handler runs, so the handler must take the
+// read lock itself while it looks at the data. It is for requests that
+// may wait on the grader.
+type handlerStudentUnlocked func(http.ResponseWriter, *http.Request, *StudentDB)
+
+func (h handlerStudentUnlocked) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log.Printf("%s %s", r.Method, r.URL.Path)
+
+	// get the session (or create a new one)
+	session, _ := store.Get(r, "codrilla-session")
+
+	// get a read lock, but only while checking the user
+	mutex.RLock()
+
+	// verify that the user is logged in
+	email, err := checkSession(session)
+	if err != nil {
+		mutex.RUnlock()
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	student, present := studentsByEmail[email]
+	mutex.RUnlock()
+	if !present {
+		log.Printf("StudentDB not found: %s", email)
+		http.Error(w, "Student record not found", http.StatusNotFound)
+		return
+	}
+
+	h(w, r, student)
+}
+
+// handlerStudentStream checks the request with a read lock held, then
+// releases the lock and sends the events from the stream the handler
+// opened (if any) for as long as the client listens
+type handlerStudentStream func(http.ResponseWriter, *http.Request, *StudentDB) *eventStream
+
+func (h handlerStudentStream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log.Printf("%s %s", r.Method, r.URL.Path)
+
+	// get the session (or create a new one)
+	session, _ := store.Get(r, "codrilla-session")
+
+	// get a read lock, but only while setting up the stream
+	mutex.RLock()
+
+	// verify that the user is logged in
+	email, err := checkSession(session)
+	if err != nil {
+		mutex.RUnlock()
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	student, present := studentsByEmail[email]
+	if !present {
+		mutex.RUnlock()
+		log.Printf("StudentDB not found: %s", email)
+		http.Error(w, "Student record not found", http.StatusNotFound)
+		return
+	}
+
+	stream := h(w, r, student)
+	mutex.RUnlock()
+
+	if stream != nil {
+		serveEventStream(w, r, stream)
+	}
+}
+
 type handlerStudentJson func(http.ResponseWriter, *http.Request, *sql.DB, *StudentDB, *json.Decoder)
 
 func (h handlerStudentJson) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -232,9 +428,9 @@ func (h handlerStudentJson) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// get the session (or create a new one)
 	session, _ := store.Get(r, "codrilla-session")
 
-	// get a read/write lock
-	mutex.Lock()
-	defer mutex.Unlock()
+	// get the writer lock; changes to memory take mutex as well
+	writeMutex.Lock()
+	defer writeMutex.Unlock()
 
 	// verify that the user is logged in
 	email, err := checkSession(session)
@@ -243,7 +439,7 @@ func (h handlerStudentJson) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if !checkJsonRequest(w, r) {
+	if !checkJsonRequest(w, r) || !checkCsrfToken(w, r, session) {
 		return
 	}
 
@@ -261,7 +457,167 @@ func (h handlerStudentJson) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	h(w, r, database, student, decoder)
 }
 
+type handlerAdmin func(http.ResponseWriter, *http.Request, *AdministratorDB)
+
+func (h handlerAdmin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log.Printf("%s %s", r.Method, r.URL.Path)
+
+	// get the session (or create a new one)
+	session, _ := store.Get(r, "codrilla-session")
+
+	// get a read lock
+	mutex.RLock()
+	defer mutex.RUnlock()
+
+	// verify that the user is logged in
+	email, err := checkSession(session)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	// check that the user is logged in as an admin
+	admin, present := administratorsByEmail[email]
+	if !present || session.Values["role"] != "admin" {
+		log.Printf("Call to %s by non-admin", r.URL.Path)
+		http.Error(w, "Must be logged in as an administrator", http.StatusForbidden)
+		return
+	}
+
+	// call the handler
+	h(w, r, admin)
+}
+
+type handlerAdminJson func(http.ResponseWriter, *http.Request, *sql.DB, *AdministratorDB, *json.Decoder)
+
+func (h handlerAdminJson) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log.Printf("%s %s", r.Method, r.URL.Path)
+
+	// get the session (or create a new one)
+	session, _ := store.Get(r, "codrilla-session")
+
+	// get the writer lock; changes to memory take mutex as well
+	writeMutex.Lock()
+	defer writeMutex.Unlock()
+
+	// verify that the user is logged in
+	email, err := checkSession(session)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	if !checkJsonRequest(w, r) || !checkCsrfToken(w, r, session) {
+		return
+	}
+
+	// check that the user is logged in as an admin
+	admin, present := administratorsByEmail[email]
+	if !present || session.Values["role"] != "admin" {
+		log.Printf("Call to %s by non-admin", r.URL.Path)
+		http.Error(w, "Must be logged in as an administrator", http.StatusForbidden)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	defer r.Body.Close()
+
+	// call the handler
+	h(w, r, database, admin, decoder)
+}
+
+// handlerStudentJsonUnlocked is for requests that wait on the grader.
+// It makes the same checks as handlerStudentJson, but holds no lock
+// while the handler runs, so the handler must take the read lock
+// itself while it looks at the data.
+type handlerStudentJsonUnlocked func(http.ResponseWriter, *http.Request, *StudentDB, *json.Decoder)
+
+func (h handlerStudentJsonUnlocked) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log.Printf("%s %s", r.Method, r.URL.Path)
+
+	// get the session (or create a new one)
+	session, _ := store.Get(r, "codrilla-session")
+
+	// get a read lock, but only while checking the user
+	mutex.RLock()
+
+	// verify that the user is logged in
+	email, err := checkSession(session)
+	if err != nil {
+		mutex.RUnlock()
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	if !checkJsonRequest(w, r) || !checkCsrfToken(w, r, session) {
+		mutex.RUnlock()
+		return
+	}
+
+	student, present := studentsByEmail[email]
+	mutex.RUnlock()
+	if !present {
+		log.Printf("StudentDB not found: %s", email)
+		http.Error(w, "Student record not found", http.StatusNotFound)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	defer r.Body.Close()
+
+	// call the handler
+	h(w, r, student, decoder)
+}
+
+// handlerAdminJsonUnlocked is like handlerStudentJsonUnlocked for
+// administrators, for requests that wait on the graders
+type handlerAdminJsonUnlocked func(http.ResponseWriter, *http.Request, *AdministratorDB, *json.Decoder)
+
+func (h handlerAdminJsonUnlocked) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log.Printf("%s %s", r.Method, r.URL.Path)
+
+	// get the session (or create a new one)
+	session, _ := store.Get(r, "codrilla-session")
+
+	// get a read lock, but only while checking the user
+	mutex.RLock()
+
+	// verify that the user is logged in
+	email, err := checkSession(session)
+	if err != nil {
+		mutex.RUnlock()
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	if !checkJsonRequest(w, r) || !checkCsrfToken(w, r, session) {
+		mutex.RUnlock()
+		return
+	}
+
+	// check that the user is logged in as an admin
+	admin, present := administratorsByEmail[email]
+	mutex.RUnlock()
+	if !present || session.Values["role"] != "admin" {
+		log.Printf("Call to %s by non-admin", r.URL.Path)
+		http.Error(w, "Must be logged in as an administrator", http.StatusForbidden)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	defer r.Body.Close()
+
+	// call the handler
+	h(w, r, admin, decoder)
+}
+
 func writeJson(w http.ResponseWriter, r *http.Request, elt interface{}) {
+	writeJsonStatus(w, r, http.StatusOK, elt)
+}
+
+// writeJsonStatus is writeJson with a status other than 200 OK, for
+// errors that come with details in JSON form
+func writeJsonStatus(w http.ResponseWriter, r *http.Request, status int, elt interface{}) {
 	if !strings.Contains(r.Header.Get("Accept"), "application/json") &&
 		!strings.Contains(r.Header.Get("Accept"), "*/*") {
 		log.Printf("Accept header missing JSON: Accept is %s", r.Header.Get("Accept"))
@@ -283,10 +639,12 @@ func writeJson(w http.ResponseWriter, r *http.Request, elt interface{}) {
 		gz.Write(raw)
 		gz.Close()
 		w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+		w.WriteHeader(status)
 		size = len(buf.Bytes())
 		actual, err = w.Write(buf.Bytes())
 	} else {
 		w.Header().Set("Content-Length", strconv.Itoa(len(raw)))
+		w.WriteHeader(status)
 		size = len(raw)
 		actual, err = w.Write(raw)
 	}
@@ -299,6 +657,22 @@ func writeJson(w http.ResponseWriter, r *http.Request, elt interface{}) {
 	}
 }
 
+func writeCsv(w http.ResponseWriter, r *http.Request, filename string, rows [][]string) {
+	var buf bytes.Buffer
+	out := csv.NewWriter(&buf)
+	if err := out.WriteAll(rows); err != nil {
+		log.Printf("Error encoding result as CSV: %v", err)
+		http.Error(w, "Failure encoding result as CSV", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		log.Printf("Error writing result: %v", err)
+	}
+}
+
 func checkJsonRequest(w http.ResponseWriter, r *http.Request) bool {
 	if r.Method != "POST" {
 		log.Printf("JSON request called with method %s", r.Method)
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/sessions"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OIDCProvider logs users in through an OpenID Connect identity
+// provider using the authorization code flow. Endpoints and signing
+// keys are found through discovery on first use.
+type OIDCProvider struct {
+	config *AuthProviderConfig
+	client *http.Client
+
+	mutex     sync.Mutex
+	discovery *OIDCDiscovery
+	keys      map[string]crypto.PublicKey
+}
+
+type OIDCDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type OIDCTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	IDToken     string `json:"id_token"`
+}
+
+type JSONWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type JSONWebKeySet struct {
+	Keys []*JSONWebKey `json:"keys"`
+}
+
+type IDTokenHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+type IDTokenClaims struct {
+	Issuer        string      `json:"iss"`
+	Audience      Audience    `json:"aud"`
+	AuthorizedBy  string      `json:"azp"`
+	Expires       int64       `json:"exp"`
+	IssuedAt      int64       `json:"iat"`
+	Nonce         string      `json:"nonce"`
+	Email         string      `json:"email"`
+	EmailVerified interface{} `json:"email_verified"`
+}
+
+// Audience is a string or a list of strings in an ID token
+type Audience []string
+
+func (a *Audience) UnmarshalJSON(raw []byte) error {
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		*a = Audience{s}
+		return nil
+	}
+	var lst []string
+	if err := json.Unmarshal(raw, &lst); err != nil {
+		return err
+	}
+	*a = Audience(lst)
+	return nil
+}
+
+// allowed difference between our clock and the identity provider's
+const oidcClockSkew = time.Minute
+
+func newOIDCProvider(elt *AuthProviderConfig) *OIDCProvider {
+	if elt.Issuer == "" || elt.ClientID == "" || elt.RedirectURI == "" {
+		log.Fatalf("OpenID Connect provider %s needs Issuer, ClientID, and RedirectURI", elt.Name)
+	}
+	return &OIDCProvider{
+		config: elt,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (p *OIDCProvider) LoginURL(r *http.Request, session *sessions.Session) (string, error) {
+	discovery, err := p.getDiscovery()
+	if err != nil {
+		return "", err
+	}
+
+	// state guards the callback against forgery, and nonce ties the
+	// ID token to this login attempt
+	state, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	nonce, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	session.Values["oidc-state"] = state
+	session.Values["oidc-nonce"] = nonce
+
+	scopes := p.config.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{"openid", "email"}
+	}
+
+	u, err := url.Parse(discovery.AuthorizationEndpoint)
+	if err != nil {
+		return "", fmt.Errorf("Bad authorization endpoint: %v", err)
+	}
+	query := u.Query()
+	query.Set("response_type", "code")
+	query.Set("client_id", p.config.ClientID)
+	query.Set("redirect_uri", p.config.RedirectURI)
+	query.Set("scope", strings.Join(scopes, " "))
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	u.RawQuery = query.Encode()
+
+	return u.String(), nil
+}
+
+func (p *OIDCProvider) Verify(r *http.Request, session *sessions.Session) (string, error) {
+	// state and nonce are good for a single attempt
+	state, _ := session.Values["oidc-state"].(string)
+	nonce, _ := session.Values["oidc-nonce"].(string)
+	delete(session.Values, "oidc-state")
+	delete(session.Values, "oidc-nonce")
+
+	if state == "" || nonce == "" {
+		log.Printf("OpenID Connect callback with no login in progress")
+		return "", nil
+	}
+
+	// the provider must return the state we sent
+	if !tokensMatch(state, r.URL.Query().Get("state")) {
+		log.Printf("OpenID Connect callback with mismatched state")
+		return "", nil
+	}
+
+	code := strings.TrimSpace(r.URL.Query().Get("code"))
+	if code == "" {
+		log.Printf("Missing OpenID Connect code")
+		return "", nil
+	}
+
+	discovery, err := p.getDiscovery()
+	if err != nil {
+		return "", err
+	}
+
+	// exchange the code for an ID token
+	resp, err := p.client.PostForm(
+		discovery.TokenEndpoint,
+		url.Values{
+			"code":          {code},
+			"client_id":     {p.config.ClientID},
+			"client_secret": {p.config.ClientSecret},
+			"redirect_uri":  {p.config.RedirectURI},
+			"grant_type":    {"authorization_code"},
+		})
+	if err != nil {
+		log.Printf("Failure contacting token endpoint %s: %v", discovery.TokenEndpoint, err)
+		return "", fmt.Errorf("Failure contacting token endpoint: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		log.Printf("Token endpoint returned a non-200 response code: %d", resp.StatusCode)
+		return "", fmt.Errorf("Token endpoint returned an error code")
+	}
+
+	token := new(OIDCTokenResponse)
+	if err = json.NewDecoder(resp.Body).Decode(token); err != nil {
+		log.Printf("Failure decoding token response: %v", err)
+		return "", fmt.Errorf("Failure decoding token response")
+	}
+	if token.IDToken == "" {
+		return "", fmt.Errorf("Token response is missing id_token")
+	}
+
+	claims, err := p.verifyIDToken(token.IDToken, nonce)
+	if err != nil {
+		log.Printf("Rejected ID token: %v", err)
+		return "", nil
+	}
+
+	// sanity checks
+	if !strings.Contains(claims.Email, "@") {
+		log.Printf("Invalid email address in ID token: [%s]", claims.Email)
+		return "", nil
+	}
+	if verified, ok := claims.EmailVerified.(bool); ok && !verified {
+		log.Printf("Unverified email address in ID token: [%s]", claims.Email)
+		return "", nil
+	}
+
+	return strings.ToLower(claims.Email), nil
+}
+
+// verifyIDToken checks the signature and claims of an ID token
+func (p *OIDCProvider) verifyIDToken(raw, nonce string) (*IDTokenClaims, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed token")
+	}
+
+	headerJson, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token header: %v", err)
+	}
+	header := new(IDTokenHeader)
+	if err = json.Unmarshal(headerJson, header); err != nil {
+		return nil, fmt.Errorf("malformed token header: %v", err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token signature: %v", err)
+	}
+
+	// check the signature
+	key, err := p.getKey(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch header.Alg {
+	case "RS256":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("key %s is not an RSA key", header.Kid)
+		}
+		if err = rsa.VerifyPKCS1v15(pub, crypto.SHA256, hash[:], signature); err != nil {
+			return nil, fmt.Errorf("bad signature: %v", err)
+		}
+
+	case "ES256":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok || len(signature) != 64 {
+			return nil, fmt.Errorf("key %s is not a P-256 key", header.Kid)
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(pub, hash[:], r, s) {
+			return nil, fmt.Errorf("bad signature")
+		}
+
+	default:
+		return nil, fmt.Errorf("unsupported signing algorithm: %s", header.Alg)
+	}
+
+	// now the claims can be trusted
+	claimsJson, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token claims: %v", err)
+	}
+	claims := new(IDTokenClaims)
+	if err = json.Unmarshal(claimsJson, claims); err != nil {
+		return nil, fmt.Errorf("malformed token claims: %v", err)
+	}
+
+	discovery, err := p.getDiscovery()
+	if err != nil {
+		return nil, err
+	}
+	if claims.Issuer != discovery.Issuer {
+		return nil, fmt.Errorf("wrong issuer: [%s] instead of [%s]", claims.Issuer, discovery.Issuer)
+	}
+	found := false
+	for _, aud := range claims.Audience {
+		if aud == p.config.ClientID {
+			found = true
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("token was not issued for this client")
+	}
+	if len(claims.Audience) > 1 && claims.AuthorizedBy != p.config.ClientID {
+		return nil, fmt.Errorf("token was not authorized for this client")
+	}
+	now := time.Now()
+	if now.After(time.Unix(claims.Expires, 0).Add(oidcClockSkew)) {
+		return nil, fmt.Errorf("token expired")
+	}
+	if now.Before(time.Unix(claims.IssuedAt, 0).Add(-oidcClockSkew)) {
+		return nil, fmt.Errorf("token issued in the future")
+	}
+	if !tokensMatch(nonce, claims.Nonce) {
+		return nil, fmt.Errorf("wrong nonce")
+	}
+
+	return claims, nil
+}
+
+func (p *OIDCProvider) getDiscovery() (*OIDCDiscovery, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	u := strings.TrimSuffix(p.config.Issuer, "/") + "/.well-known/openid-configuration"
+	discovery := new(OIDCDiscovery)
+	if err := p.getJson(u, discovery); err != nil {
+		return nil, err
+	}
+	if discovery.Issuer != p.config.Issuer {
+		log.Printf("Discovery document from %s names issuer %s", u, discovery.Issuer)
+		return nil, fmt.Errorf("Issuer mismatch in discovery document")
+	}
+	if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.JWKSURI == "" {
+		return nil, fmt.Errorf("Incomplete discovery document from %s", u)
+	}
+
+	p.discovery = discovery
+	return discovery, nil
+}
+
+// getKey finds a signing key by ID, reloading the key set when an
+// unknown key is requested in case the provider has rotated keys
+func (p *OIDCProvider) getKey(kid string) (crypto.PublicKey, error) {
+	discovery, err := p.getDiscovery()
+	if err != nil {
+		return nil, err
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if key, present := p.keys[kid]; present {
+		return key, nil
+	}
+
+	set := new(JSONWebKeySet)
+	if err := p.getJson(discovery.JWKSURI, set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, elt := range set.Keys {
+		key, err := elt.publicKey()
+		if err != nil {
+			log.Printf("Skipping key %s from %s: %v", elt.Kid, discovery.JWKSURI, err)
+			continue
+		}
+		keys[elt.Kid] = key
+	}
+	p.keys = keys
+
+	if key, present := p.keys[kid]; present {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key: %s", kid)
+}
+
+func (p *OIDCProvider) getJson(u string, elt interface{}) error {
+	resp, err := p.client.Get(u)
+	if err != nil {
+		log.Printf("Failure contacting %s: %v", u, err)
+		return fmt.Errorf("Failure contacting identity provider: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		log.Printf("Got response %d: %s from %s", resp.StatusCode, resp.Status, u)
+		return fmt.Errorf("Identity provider returned an error code")
+	}
+	if err = json.NewDecoder(resp.Body).Decode(elt); err != nil {
+		log.Printf("Failure decoding response from %s: %v", u, err)
+		return fmt.Errorf("Failure decoding identity provider response")
+	}
+	return nil
+}
+
+func (k *JSONWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}, nil
+
+	default:
+		return nil, fmt.Errorf("unsupported key type %s", k.Kty)
+	}
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/gorilla/sessions"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// testIdentityProvider is a local stand-in for an OpenID Connect
+// identity provider. It serves discovery, a key set with one RSA and
+// one P-256 key, and a token endpoint that hands out IDToken for the
+// code "good".
+type testIdentityProvider struct {
+	server  *httptest.Server
+	rsaKey  *rsa.PrivateKey
+	ecKey   *ecdsa.PrivateKey
+	IDToken string
+}
+
+func newTestIdentityProvider(t *testing.T) *testIdentityProvider {
+	idp := new(testIdentityProvider)
+	var err error
+	if idp.rsaKey, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+		t.Fatalf("generating RSA key: %v", err)
+	}
+	if idp.ecKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+		t.Fatalf("generating EC key: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(&OIDCDiscovery{
+			Issuer:                idp.server.URL,
+			AuthorizationEndpoint: idp.server.URL + "/authorize",
+			TokenEndpoint:         idp.server.URL + "/token",
+			JWKSURI:               idp.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		pad := func(n *big.Int) string {
+			raw := make([]byte, 32)
+			n.FillBytes(raw)
+			return base64.RawURLEncoding.EncodeToString(raw)
+		}
+		json.NewEncoder(w).Encode(&JSONWebKeySet{Keys: []*JSONWebKey{
+			{
+				Kty: "RSA",
+				Kid: "rsa1",
+				N:   base64.RawURLEncoding.EncodeToString(idp.rsaKey.N.Bytes()),
+				E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(idp.rsaKey.E)).Bytes()),
+			},
+			{
+				Kty: "EC",
+				Kid: "ec1",
+				Crv: "P-256",
+				X:   pad(idp.ecKey.X),
+				Y:   pad(idp.ecKey.Y),
+			},
+		}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.PostFormValue("code") != "good" || r.PostFormValue("client_id") != "codrilla" {
+			http.Error(w, "invalid_grant", http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(&OIDCTokenResponse{
+			AccessToken: "access",
+			TokenType:   "Bearer",
+			IDToken:     idp.IDToken,
+		})
+	})
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+	return idp
+}
+
+func (idp *testIdentityProvider) provider() *OIDCProvider {
+	return newOIDCProvider(&AuthProviderConfig{
+		Name:        "test",
+		Type:        "oidc",
+		Issuer:      idp.server.URL,
+		ClientID:    "codrilla",
+		RedirectURI: "https://codrilla.example.com/auth/callback/test",
+	})
+}
+
+// claims returns a valid set of claims for the given nonce
+func (idp *testIdentityProvider) claims(nonce string) map[string]interface{} {
+	now := time.Now()
+	return map[string]interface{}{
+		"iss":            idp.server.URL,
+		"aud":            "codrilla",
+		"exp":            now.Add(5 * time.Minute).Unix(),
+		"iat":            now.Unix(),
+		"nonce":          nonce,
+		"email":          "Student@Example.com",
+		"email_verified": true,
+	}
+}
+
+// sign makes a compact JWT with the given algorithm, key ID, and key
+func sign(t *testing.T, alg, kid string, key crypto.Signer, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	body, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatalf("encoding claims: %v", err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(body)
+	hash := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		if signature, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, hash[:]); err != nil {
+			t.Fatalf("RSA signing: %v", err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, hash[:])
+		if err != nil {
+			t.Fatalf("ECDSA signing: %v", err)
+		}
+		signature = make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// startLogin runs the first half of a login and returns the session
+// along with the state and nonce sent to the identity provider
+func startLogin(t *testing.T, p *OIDCProvider) (*sessions.Session, string, string) {
+	session := sessions.NewSession(nil, "codrilla")
+	r := httptest.NewRequest("GET", "/auth/login/test", nil)
+	loginURL, err := p.LoginURL(r, session)
+	if err != nil {
+		t.Fatalf("LoginURL: %v", err)
+	}
+	u, err := url.Parse(loginURL)
+	if err != nil {
+		t.Fatalf("bad login URL %s: %v", loginURL, err)
+	}
+	query := u.Query()
+	if query.Get("client_id") != "codrilla" || query.Get("response_type") != "code" {
+		t.Fatalf("login URL missing client_id or response_type: %s", loginURL)
+	}
+	state, nonce := query.Get("state"), query.Get("nonce")
+	if state == "" || nonce == "" || session.Values["oidc-state"] != state || session.Values["oidc-nonce"] != nonce {
+		t.Fatalf("state and nonce not recorded in the session")
+	}
+	return session, state, nonce
+}
+
+// finishLogin runs the callback half of a login
+func finishLogin(t *testing.T, p *OIDCProvider, session *sessions.Session, state string) string {
+	r := httptest.NewRequest("GET", "/auth/callback/test?"+url.Values{"state": {state}, "code": {"good"}}.Encode(), nil)
+	email, err := p.Verify(r, session)
+	if err != nil {
+		t.Fatalf("Verify returned an error: %v", err)
+	}
+	return email
+}
+
+func TestOIDCAcceptsGoodTokens(t *testing.T) {
+	idp := newTestIdentityProvider(t)
+	p := idp.provider()
+
+	for _, alg := range []string{"RS256", "ES256"} {
+		session, state, nonce := startLogin(t, p)
+		if alg == "RS256" {
+			idp.IDToken = sign(t, alg, "rsa1", idp.rsaKey, idp.claims(nonce))
+		} else {
+			idp.IDToken = sign(t, alg, "ec1", idp.ecKey, idp.claims(nonce))
+		}
+		if email := finishLogin(t, p, session, state); email != "student@example.com" {
+			t.Errorf("%s: expected login for student@example.com, got [%s]", alg, email)
+		}
+
+		// state and nonce are good for one attempt only
+		if email := finishLogin(t, p, session, state); email != "" {
+			t.Errorf("%s: callback replay accepted for [%s]", alg, email)
+		}
+	}
+}
+
+func TestOIDCRejectsBadTokens(t *testing.T) {
+	idp := newTestIdentityProvider(t)
+	p := idp.provider()
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generating RSA key: %v", err)
+	}
+
+	cases := []struct {
+		name   string
+		modify func(claims map[string]interface{})
+		key    crypto.Signer
+	}{
+		{"bad signature", nil, otherKey},
+		{"wrong audience", func(c map[string]interface{}) { c["aud"] = "someone-else" }, nil},
+		{"wrong issuer", func(c map[string]interface{}) { c["iss"] = "https://evil.example.com" }, nil},
+		{"expired", func(c map[string]interface{}) {
+			c["iat"] = time.Now().Add(-time.Hour).Unix()
+			c["exp"] = time.Now().Add(-30 * time.Minute).Unix()
+		}, nil},
+		{"wrong nonce", func(c map[string]interface{}) { c["nonce"] = "not-the-nonce" }, nil},
+		{"unverified email", func(c map[string]interface{}) { c["email_verified"] = false }, nil},
+	}
+	for _, elt := range cases {
+		session, state, nonce := startLogin(t, p)
+		claims := idp.claims(nonce)
+		if elt.modify != nil {
+			elt.modify(claims)
+		}
+		key := elt.key
+		if key == nil {
+			key = idp.rsaKey
+		}
+		idp.IDToken = sign(t, "RS256", "rsa1", key, claims)
+		if email := finishLogin(t, p, session, state); email != "" {
+			t.Errorf("%s: token accepted for [%s]", elt.name, email)
+		}
+	}
+
+	// an ES256 signature from the wrong key
+	session, state, nonce := startLogin(t, p)
+	otherEC, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating EC key: %v", err)
+	}
+	idp.IDToken = sign(t, "ES256", "ec1", otherEC, idp.claims(nonce))
+	if email := finishLogin(t, p, session, state); email != "" {
+		t.Errorf("bad ES256 signature: token accepted for [%s]", email)
+	}
+}
+
+func TestOIDCRejectsStateMismatch(t *testing.T) {
+	idp := newTestIdentityProvider(t)
+	p := idp.provider()
+
+	session, _, nonce := startLogin(t, p)
+	idp.IDToken = sign(t, "RS256", "rsa1", idp.rsaKey, idp.claims(nonce))
+	if email := finishLogin(t, p, session, "forged-state"); email != "" {
+		t.Errorf("callback with the wrong state accepted for [%s]", email)
+	}
+
+	// a callback with no login in progress
+	session = sessions.NewSession(nil, "codrilla")
+	if email := finishLogin(t, p, session, "any-state"); email != "" {
+		t.Errorf("callback with no login in progress accepted for [%s]", email)
+	}
+}
+
+func TestOIDCFailedCallbackClearsState(t *testing.T) {
+	idp := newTestIdentityProvider(t)
+	timeZone = time.UTC
+	store = sessions.NewCookieStore([]byte("oidc-test-secret"))
+	authProviders["test"] = idp.provider()
+	t.Cleanup(func() { delete(authProviders, "test") })
+
+	// start a login through the server
+	w := httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(w, httptest.NewRequest("GET", "/auth/login/test", nil))
+	if w.Code != http.StatusFound {
+		t.Fatalf("login returned %d", w.Code)
+	}
+	u, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatalf("bad login redirect: %v", err)
+	}
+	state := u.Query().Get("state")
+	cookies := w.Result().Cookies()
+
+	// a callback that fails still saves the session, so the state
+	// cannot be used again
+	idp.IDToken = sign(t, "RS256", "rsa1", idp.rsaKey, idp.claims("not-the-nonce"))
+	r := httptest.NewRequest("GET", "/auth/callback/test?"+url.Values{"state": {state}, "code": {"good"}}.Encode(), nil)
+	for _, cookie := range cookies {
+		r.AddCookie(cookie)
+	}
+	w = httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("failed callback returned %d", w.Code)
+	}
+
+	r = httptest.NewRequest("GET", "/", nil)
+	for _, cookie := range w.Result().Cookies() {
+		r.AddCookie(cookie)
+	}
+	session, err := store.Get(r, "codrilla-session")
+	if err != nil {
+		t.Fatalf("decoding session: %v", err)
+	}
+	if session.IsNew || session.Values["oidc-state"] != nil || session.Values["oidc-nonce"] != nil {
+		t.Errorf("session still holds the login state after a failed callback")
+	}
+}
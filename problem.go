@@ -3,13 +3,16 @@ package main
 import (
 	"database/sql"
 	"encoding/json"
+	"fmt"
 	"github.com/gorilla/pat"
+	"io/ioutil"
 	"log"
 	"net/http"
-	"net/url"
+	"reflect"
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 	"unicode"
 )
 
@@ -57,36 +60,263 @@ type ProblemType struct {
 	FieldList []ProblemField
 }
 
+// problemTypeLists[address] is the list of problem types each grader
+// last reported. Only writers (holding writeMutex) change it, and they
+// take mutex as well so a refresh can read it with only a read lock.
+var problemTypeLists = make(map[string][]*ProblemType)
+
+// problemTypesVersion counts refreshes, so a refresh can tell if
+// another one finished while it was asking the graders
+var problemTypesVersion int
+
 func setupProblemTypes() {
-	// first get the list of problem types from the grader
-	u := &url.URL{
-		Scheme: "http",
-		Host:   config.GraderAddress,
-		Path:   "/list",
+	// load the copy saved last time, keyed by grader address
+	cached := make(map[string][]*ProblemType)
+	if raw, err := ioutil.ReadFile(config.ProblemTypeCacheFile); err == nil {
+		if err = json.Unmarshal(raw, &cached); err != nil {
+			log.Printf("Failed to decode cached problem types from %s: %v", config.ProblemTypeCacheFile, err)
+		}
+	}
+
+	types, byType, lists := loadProblemTypes(cached)
+	if len(types) == 0 {
+		log.Fatalf("No problem types available from any grader")
+	}
+	for tag, _ := range types {
+		log.Printf("Adding %s problem type", tag)
+	}
+	problemTypes = types
+	gradersByType = byType
+	problemTypeLists = lists
+
+	saveProblemTypes(lists)
+}
+
+// loadProblemTypes asks every grader for its list of problem types. A
+// grader that does not answer is assumed to serve the types listed for
+// it in previous, if any.
+func loadProblemTypes(previous map[string][]*ProblemType) (map[string]*ProblemType, map[string][]*GraderClient, map[string][]*ProblemType) {
+	types := make(map[string]*ProblemType)
+	byType := make(map[string][]*GraderClient)
+	lists := make(map[string][]*ProblemType)
+
+	for _, g := range graders {
+		// get the list of problem types from each grader
+		var list []*ProblemType
+		err := g.Do("GET", "/list", nil, &list)
+		if err == nil && len(list) == 0 {
+			err = fmt.Errorf("List of problem types is empty")
+		}
+		if err != nil {
+			// carry on in degraded mode with the saved copy
+			log.Printf("Failed to load problem type list from grader at %s: %v", g.Address, err)
+			list = previous[g.Address]
+			if len(list) == 0 {
+				log.Printf("No saved problem types for grader at %s", g.Address)
+				continue
+			}
+			log.Printf("Using saved problem types for grader at %s", g.Address)
+		}
+		lists[g.Address] = list
+
+		for _, elt := range list {
+			if existing, present := types[elt.Tag]; present {
+				if !reflect.DeepEqual(existing, elt) {
+					log.Printf("Warning: grader at %s has a different definition of problem type %s", g.Address, elt.Tag)
+				}
+			} else {
+				types[elt.Tag] = elt
+			}
+			log.Printf("Grader at %s serves problem type %s", g.Address, elt.Tag)
+			byType[elt.Tag] = append(byType[elt.Tag], g)
+		}
+	}
+
+	return types, byType, lists
+}
+
+// save a copy in case a grader is down the next time we start
+func saveProblemTypes(lists map[string][]*ProblemType) {
+	raw, err := json.MarshalIndent(lists, "", "    ")
+	if err == nil {
+		err = ioutil.WriteFile(config.ProblemTypeCacheFile, raw, 0644)
 	}
-	resp, err := http.Get(u.String())
 	if err != nil {
-		log.Fatalf("Failed to load problem type list from %s: %v", u.String(), err)
+		log.Printf("Failed to save problem types to %s: %v", config.ProblemTypeCacheFile, err)
+	}
+}
+
+type ProblemTypeChange struct {
+	Tag           string
+	FieldsAdded   []string
+	FieldsRemoved []string
+	FieldsChanged []string
+}
+
+type ProblemTypeRefreshResponse struct {
+	Added   []string
+	Removed []string
+	Changed []*ProblemTypeChange
+}
+
+// diffProblemTypes reports the types and fields that differ between
+// the old and new sets of problem types
+func diffProblemTypes(old, new map[string]*ProblemType) *ProblemTypeRefreshResponse {
+	resp := &ProblemTypeRefreshResponse{
+		Added:   []string{},
+		Removed: []string{},
+		Changed: []*ProblemTypeChange{},
+	}
+	for tag, _ := range new {
+		if _, present := old[tag]; !present {
+			resp.Added = append(resp.Added, tag)
+		}
+	}
+	for tag, oldType := range old {
+		newType, present := new[tag]
+		if !present {
+			resp.Removed = append(resp.Removed, tag)
+			continue
+		}
+		if reflect.DeepEqual(oldType, newType) {
+			continue
+		}
+
+		change := &ProblemTypeChange{
+			Tag:           tag,
+			FieldsAdded:   []string{},
+			FieldsRemoved: []string{},
+			FieldsChanged: []string{},
+		}
+		oldFields := make(map[string]ProblemField)
+		for _, field := range oldType.FieldList {
+			oldFields[field.Name] = field
+		}
+		newFields := make(map[string]ProblemField)
+		for _, field := range newType.FieldList {
+			newFields[field.Name] = field
+			if oldField, present := oldFields[field.Name]; !present {
+				change.FieldsAdded = append(change.FieldsAdded, field.Name)
+			} else if oldField != field {
+				change.FieldsChanged = append(change.FieldsChanged, field.Name)
+			}
+		}
+		for _, field := range oldType.FieldList {
+			if _, present := newFields[field.Name]; !present {
+				change.FieldsRemoved = append(change.FieldsRemoved, field.Name)
+			}
+		}
+		resp.Changed = append(resp.Changed, change)
+	}
+	sort.Strings(resp.Added)
+	sort.Strings(resp.Removed)
+	sort.Sort(ProblemTypeChangesByTag(resp.Changed))
+
+	return resp
+}
+
+type ProblemTypeChangesByTag []*ProblemTypeChange
+
+func (p ProblemTypeChangesByTag) Len() int           { return len(p) }
+func (p ProblemTypeChangesByTag) Less(i, j int) bool { return p[i].Tag < p[j].Tag }
+func (p ProblemTypeChangesByTag) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+// refreshProblemTypes fetches the problem types from the graders again
+// and swaps them in all at once. A refresh that would drop a type still
+// used by a problem is refused and changes nothing. The graders are
+// asked with no lock held, so the caller must not hold either lock.
+func refreshProblemTypes() (*ProblemTypeRefreshResponse, error) {
+	mutex.RLock()
+	previous, oldTypes, version := problemTypeLists, problemTypes, problemTypesVersion
+	mutex.RUnlock()
+
+	types, byType, lists := loadProblemTypes(previous)
+	if len(types) == 0 {
+		return nil, fmt.Errorf("No problem types available from any grader")
+	}
+	resp := diffProblemTypes(oldTypes, types)
+
+	writeMutex.Lock()
+	defer writeMutex.Unlock()
+
+	// another refresh may have swapped in types in the meantime
+	if problemTypesVersion != version {
+		resp = diffProblemTypes(problemTypes, types)
+	}
+
+	// every problem must still have a type, including problems created
+	// while the graders were being asked
+	removed := make(map[string]bool)
+	for _, tag := range resp.Removed {
+		removed[tag] = true
+	}
+	orphans := []int64{}
+	for id, problem := range problemsByID {
+		if removed[problem.Type.Tag] {
+			orphans = append(orphans, id)
+		}
 	}
-	if resp.StatusCode != 200 {
-		log.Fatalf("Go response %d: %s from %s", resp.StatusCode, resp.Status, u.String())
+	if len(orphans) > 0 {
+		sort.Sort(Int64Slice(orphans))
+		log.Printf("Refusing problem type refresh: removes types %v used by problems %v", resp.Removed, orphans)
+		return nil, fmt.Errorf("Refusing to remove problem types %s still used by problems %v",
+			strings.Join(resp.Removed, ", "), orphans)
 	}
-	defer resp.Body.Close()
 
-	var list []*ProblemType
-	if err = json.NewDecoder(resp.Body).Decode(&list); err != nil {
-		log.Fatalf("Failed to decode response from %s: %v", u.String(), err)
+	// swap in the new types
+	mutex.Lock()
+	problemTypes = types
+	for _, problem := range problemsByID {
+		problem.Type = types[problem.Type.Tag]
+	}
+	problemTypeLists = lists
+	problemTypesVersion++
+	mutex.Unlock()
+
+	gradersMutex.Lock()
+	gradersByType = byType
+	gradersMutex.Unlock()
+
+	// expected output may depend on the changed fields
+	changed := make(map[string]bool)
+	for _, change := range resp.Changed {
+		changed[change.Tag] = true
 	}
+	outputMutex.Lock()
+	for id, _ := range outputByProblemID {
+		if problem, present := problemsByID[id]; !present || changed[problem.Type.Tag] {
+			delete(outputByProblemID, id)
+		}
+	}
+	outputMutex.Unlock()
 
-	if len(list) == 0 {
-		log.Fatalf("List of problem types from %s is empty", u.String())
+	for _, tag := range resp.Added {
+		log.Printf("Adding %s problem type", tag)
+	}
+	for _, tag := range resp.Removed {
+		log.Printf("Removing %s problem type", tag)
 	}
+	for _, change := range resp.Changed {
+		log.Printf("Problem type %s changed: fields added %v, removed %v, changed %v",
+			change.Tag, change.FieldsAdded, change.FieldsRemoved, change.FieldsChanged)
+	}
+
+	saveProblemTypes(lists)
 
-	problemTypes = make(map[string]*ProblemType)
+	// queued work may have a grader now
+	wakeGradeWorkers()
 
-	for _, elt := range list {
-		log.Printf("Adding %s problem type", elt.Tag)
-		problemTypes[elt.Tag] = elt
+	return resp, nil
+}
+
+// refreshProblemTypesEvery refreshes the problem types periodically
+func refreshProblemTypesEvery(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+
+		if _, err := refreshProblemTypes(); err != nil {
+			log.Printf("Periodic problem type refresh failed: %v", err)
+		}
 	}
 }
 
@@ -279,9 +509,12 @@ func problem_save_common(w http.ResponseWriter, r *http.Request, db *sql.DB, ins
 	}
 
 	// delete cached output
+	outputMutex.Lock()
 	delete(outputByProblemID, problem.ID)
+	outputMutex.Unlock()
 
 	// update in-memory version
+	mutex.Lock()
 	var p *ProblemDB
 	if id >= 0 {
 		// update in place
@@ -325,6 +558,7 @@ func problem_save_common(w http.ResponseWriter, r *http.Request, db *sql.DB, ins
 		tag.Problems[problem.ID] = p
 		p.Tags[tagName] = tag
 	}
+	mutex.Unlock()
 
 	// note: assignments are not affected by problem updates, so we ignore asst links
 
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/sessions"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// setupRaceDatabase builds a small course in a shared in-memory
+// database, loads it the way the server does at startup, and starts
+// grade workers against a local grader that passes everything
+func setupRaceDatabase(t *testing.T, students int) (assignmentID int64) {
+	timeZone = time.UTC
+	store = sessions.NewCookieStore([]byte("race-test-secret"))
+	config.DatabaseName = "file:racetest?mode=memory&cache=shared"
+	config.GraderWorkers = 4
+
+	// the in-memory database lives as long as one connection stays open
+	keep, err := sql.Open("sqlite3", config.DatabaseName)
+	if err != nil {
+		t.Fatalf("opening in-memory database: %v", err)
+	}
+	t.Cleanup(func() { keep.Close() })
+	schema, err := ioutil.ReadFile("schema.sql")
+	if err != nil {
+		t.Fatalf("reading schema: %v", err)
+	}
+	if _, err = keep.Exec(string(schema)); err != nil {
+		t.Fatalf("creating schema: %v", err)
+	}
+
+	now := time.Now().In(timeZone)
+	exec := func(query string, args ...interface{}) {
+		if _, err := keep.Exec(query, args...); err != nil {
+			t.Fatalf("seeding database: %s: %v", query, err)
+		}
+	}
+	exec("insert into Instructor values (?, ?)", "prof@example.com", "Prof")
+	exec("insert into Course values (?, ?, ?)", "CS1400", "Intro", now.Add(24*time.Hour))
+	exec("insert into CourseInstructor values (?, ?)", "CS1400", "prof@example.com")
+	for i := 0; i < students; i++ {
+		email := fmt.Sprintf("student%d@example.com", i)
+		exec("insert into Student values (?, ?, ?)", email, email, "")
+		exec("insert into CourseStudent values (?, ?)", "CS1400", email)
+	}
+	exec("insert into Problem values (1, ?, ?, ?)", "Hello", "python", `{"Description":"say hello"}`)
+	exec("insert into Assignment values (1, ?, 1, 1, ?, ?, 0, 0, 1, 0, 0, 0)",
+		"CS1400", now.Add(-time.Hour), now.Add(time.Hour))
+
+	problemTypes = map[string]*ProblemType{
+		"python": {
+			Name: "Python",
+			Tag:  "python",
+			FieldList: []ProblemField{
+				{Name: "Description", Creator: "edit", Student: "view", Grader: "nothing"},
+				{Name: "Source", Creator: "nothing", Student: "edit", Grader: "view"},
+			},
+		},
+	}
+
+	grader := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Millisecond)
+		json.NewEncoder(w).Encode(map[string]interface{}{"Passed": true, "Score": 1.0, "MaxScore": 1.0})
+	}))
+	t.Cleanup(grader.Close)
+	g := newGraderClient(grader.Listener.Addr().String())
+	gradersMutex.Lock()
+	graders = []*GraderClient{g}
+	gradersByType["python"] = graders
+	gradersMutex.Unlock()
+
+	initDatabase()
+	startGradeWorkers()
+
+	return 1
+}
+
+// raceLogin makes a session cookie for a user, along with the matching
+// CSRF token
+func raceLogin(t *testing.T, email, role string) (*http.Cookie, string) {
+	r := httptest.NewRequest("GET", "/auth/login", nil)
+	w := httptest.NewRecorder()
+	session, _ := store.New(r, "codrilla-session")
+	token := "token-" + email
+	session.Values["role"] = role
+	session.Values["email"] = email
+	session.Values["csrf"] = token
+	session.Values["expires"] = time.Now().Add(time.Hour).Unix()
+	if err := session.Save(r, w); err != nil {
+		t.Fatalf("saving session: %v", err)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) == 0 {
+		t.Fatalf("no session cookie set")
+	}
+	return cookies[0], token
+}
+
+func raceRequest(method, path string, cookie *http.Cookie, token string, body interface{}) *httptest.ResponseRecorder {
+	var r *http.Request
+	if body != nil {
+		raw, _ := json.Marshal(body)
+		r = httptest.NewRequest(method, path, bytes.NewReader(raw))
+		r.Header.Set("Content-Type", "application/json")
+	} else {
+		r = httptest.NewRequest(method, path, nil)
+	}
+	r.Header.Set("Accept", "application/json")
+	r.Header.Set("X-CSRF-Token", token)
+	r.AddCookie(cookie)
+	w := httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(w, r)
+	return w
+}
+
+// TestConcurrentSubmitReadGrade runs student submissions, student and
+// instructor reads, and the grade workers all at once. It is meant to
+// be run with go test -race, which reports any unguarded access.
+func TestConcurrentSubmitReadGrade(t *testing.T) {
+	const students = 8
+	const submits = 20
+	asst := setupRaceDatabase(t, students)
+	profCookie, profToken := raceLogin(t, "prof@example.com", "instructor")
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+
+	// students submit, and check their own assignment page as they go
+	var submitters sync.WaitGroup
+	for i := 0; i < students; i++ {
+		email := fmt.Sprintf("student%d@example.com", i)
+		cookie, token := raceLogin(t, email, "student")
+		submitters.Add(1)
+		go func() {
+			defer submitters.Done()
+			for n := 0; n < submits; n++ {
+				w := raceRequest("POST", fmt.Sprintf("/student/submit/%d", asst), cookie, token,
+					map[string]interface{}{"Source": fmt.Sprintf("print(%d)", n)})
+				if w.Code != http.StatusOK {
+					t.Errorf("submit by %s: %d %s", email, w.Code, strings.TrimSpace(w.Body.String()))
+				}
+				w = raceRequest("GET", fmt.Sprintf("/student/assignment/%d", asst), cookie, token, nil)
+				if w.Code != http.StatusOK {
+					t.Errorf("assignment view by %s: %d %s", email, w.Code, strings.TrimSpace(w.Body.String()))
+				}
+			}
+		}()
+	}
+
+	// the instructor reads the grade book and submission lists throughout
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			w := raceRequest("GET", "/course/grades/CS1400", profCookie, profToken, nil)
+			if w.Code != http.StatusOK {
+				t.Errorf("grades: %d %s", w.Code, strings.TrimSpace(w.Body.String()))
+			}
+			w = raceRequest("GET", fmt.Sprintf("/course/submissions/%d?student=student0@example.com", asst), profCookie, profToken, nil)
+			if w.Code != http.StatusOK {
+				t.Errorf("submissions: %d %s", w.Code, strings.TrimSpace(w.Body.String()))
+			}
+			w = raceRequest("GET", "/course/gradequeue/CS1400", profCookie, profToken, nil)
+			if w.Code != http.StatusOK {
+				t.Errorf("grade queue: %d %s", w.Code, strings.TrimSpace(w.Body.String()))
+			}
+		}
+	}()
+
+	submitters.Wait()
+
+	// wait for the workers to grade everything
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		mutex.RLock()
+		graded := 0
+		for _, solution := range solutionsByID {
+			for _, sub := range solution.SubmissionsInOrder {
+				if len(sub.GradeReport) > 0 {
+					graded++
+				}
+			}
+		}
+		mutex.RUnlock()
+		if graded == students*submits {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("only %d of %d submissions graded", graded, students*submits)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(done)
+	wg.Wait()
+
+	// the database agrees with memory
+	var count int
+	if err := database.QueryRow("select count(*) from Submission where GradeReport <> '' and Passed").Scan(&count); err != nil {
+		t.Fatalf("counting submissions: %v", err)
+	}
+	if count != students*submits {
+		t.Errorf("expected %d graded submissions in the database, found %d", students*submits, count)
+	}
+	if err := database.QueryRow("select count(*) from GradingRun").Scan(&count); err != nil {
+		t.Fatalf("counting grading runs: %v", err)
+	}
+	if count != students*submits {
+		t.Errorf("expected %d grading runs in the database, found %d", students*submits, count)
+	}
+}
@@ -0,0 +1,529 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// how long a preview token for a destructive roster sync stays valid
+const rosterTokenLifetime = 15 * time.Minute
+
+// rosterToken records a preview that a destructive sync may follow.
+// rosterTokens is only used by JSON handlers, so writeMutex protects it.
+type rosterToken struct {
+	Course     string
+	Instructor string
+	Digest     string
+	Expires    time.Time
+}
+
+var rosterTokens = make(map[string]*rosterToken)
+
+type RosterUpload struct {
+	Students [][]string
+	Csv      string
+	Columns  *RosterColumns
+	Mode     string
+	Preview  bool
+	Token    string
+}
+
+// RosterColumns names the header of each CSV column to use. Name can be
+// given whole or as FirstName and LastName, and a Username gets the
+// student email domain added.
+type RosterColumns struct {
+	Name      string
+	FirstName string
+	LastName  string
+	Email     string
+	Username  string
+	StudentID string
+}
+
+// header names to try for any column that is not given
+var rosterColumnDefaults = &RosterColumns{
+	Name:      "name",
+	FirstName: "first name",
+	LastName:  "last name",
+	Email:     "email",
+	Username:  "username",
+	StudentID: "student id",
+}
+
+type RosterStudent struct {
+	Email     string
+	Name      string
+	StudentID string
+}
+
+type RosterError struct {
+	Line    int
+	Message string
+}
+
+type rosterRow struct {
+	Line      int
+	Name      string
+	Email     string
+	StudentID string
+}
+
+type RosterRename struct {
+	Email   string
+	OldName string
+	NewName string
+}
+
+type RosterChanges struct {
+	Mode       string
+	Applied    bool
+	Token      string
+	Errors     []*RosterError
+	Added      []*RosterStudent
+	Removed    []*RosterStudent
+	Renamed    []*RosterRename
+	StudentIDs []*RosterStudent
+	Unchanged  int
+}
+
+type RosterStudentsByEmail []*RosterStudent
+
+func (p RosterStudentsByEmail) Len() int           { return len(p) }
+func (p RosterStudentsByEmail) Less(i, j int) bool { return p[i].Email < p[j].Email }
+func (p RosterStudentsByEmail) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+type RosterErrorsByLine []*RosterError
+
+func (p RosterErrorsByLine) Len() int           { return len(p) }
+func (p RosterErrorsByLine) Less(i, j int) bool { return p[i].Line < p[j].Line }
+func (p RosterErrorsByLine) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+type RosterRenamesByEmail []*RosterRename
+
+func (p RosterRenamesByEmail) Len() int           { return len(p) }
+func (p RosterRenamesByEmail) Less(i, j int) bool { return p[i].Email < p[j].Email }
+func (p RosterRenamesByEmail) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+// getRosterChanges works out what an upload would do to a course. In
+// merge mode nobody is removed.
+func getRosterChanges(course *CourseDB, students map[string]*RosterStudent, mode string) *RosterChanges {
+	changes := &RosterChanges{
+		Mode:       mode,
+		Errors:     []*RosterError{},
+		Added:      []*RosterStudent{},
+		Removed:    []*RosterStudent{},
+		Renamed:    []*RosterRename{},
+		StudentIDs: []*RosterStudent{},
+	}
+	for email, elt := range students {
+		student, present := studentsByEmail[email]
+		renamed := present && student.Name != elt.Name
+		newID := present && elt.StudentID != "" && student.StudentID != elt.StudentID
+		if renamed {
+			changes.Renamed = append(changes.Renamed, &RosterRename{Email: email, OldName: student.Name, NewName: elt.Name})
+		}
+		if newID {
+			changes.StudentIDs = append(changes.StudentIDs, elt)
+		}
+		if _, enrolled := course.Students[email]; !enrolled {
+			changes.Added = append(changes.Added, elt)
+		} else if !renamed && !newID {
+			changes.Unchanged++
+		}
+	}
+	for email, student := range course.Students {
+		if _, present := students[email]; present {
+			continue
+		}
+		if mode == "merge" {
+			changes.Unchanged++
+		} else {
+			changes.Removed = append(changes.Removed, &RosterStudent{Email: email, Name: student.Name, StudentID: student.StudentID})
+		}
+	}
+	sort.Sort(RosterStudentsByEmail(changes.Added))
+	sort.Sort(RosterStudentsByEmail(changes.Removed))
+	sort.Sort(RosterRenamesByEmail(changes.Renamed))
+	sort.Sort(RosterStudentsByEmail(changes.StudentIDs))
+	return changes
+}
+
+// digest summarizes a set of changes, so a sync can confirm that it
+// matches what was previewed
+func (changes *RosterChanges) digest(course *CourseDB) string {
+	lines := []string{course.Tag}
+	for _, elt := range changes.Added {
+		lines = append(lines, "+"+elt.Email+"\t"+elt.Name)
+	}
+	for _, elt := range changes.Removed {
+		lines = append(lines, "-"+elt.Email)
+	}
+	for _, elt := range changes.Renamed {
+		lines = append(lines, "~"+elt.Email+"\t"+elt.NewName)
+	}
+	for _, elt := range changes.StudentIDs {
+		lines = append(lines, "#"+elt.Email+"\t"+elt.StudentID)
+	}
+	sum := sha256.Sum256([]byte(strings.Join(lines, "\n")))
+	return hex.EncodeToString(sum[:])
+}
+
+// findRosterColumn returns the index of the named column in a CSV
+// header, or -1 if it is not there
+func findRosterColumn(header []string, name string) int {
+	name = strings.ToLower(strings.TrimSpace(name))
+	for i, elt := range header {
+		if strings.ToLower(strings.TrimSpace(elt)) == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// parseRosterCsv reads a roster in CSV form, such as a registrar export.
+// The first row must be a header naming the columns. Rows that cannot be
+// read are reported by line number and skipped.
+func parseRosterCsv(text string, columns *RosterColumns) ([]*rosterRow, []*RosterError, error) {
+	reader := csv.NewReader(strings.NewReader(strings.TrimPrefix(text, "\ufeff")))
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error reading CSV header: %v", err)
+	}
+
+	// find each column, by the given name or by the default one
+	if columns == nil {
+		columns = new(RosterColumns)
+	}
+	find := func(given, fallback string) (int, error) {
+		if given == "" {
+			return findRosterColumn(header, fallback), nil
+		}
+		if n := findRosterColumn(header, given); n >= 0 {
+			return n, nil
+		}
+		return -1, fmt.Errorf("CSV header has no column named %s", given)
+	}
+	var name, first, last, email, username, sid int
+	if name, err = find(columns.Name, rosterColumnDefaults.Name); err != nil {
+		return nil, nil, err
+	}
+	if first, err = find(columns.FirstName, rosterColumnDefaults.FirstName); err != nil {
+		return nil, nil, err
+	}
+	if last, err = find(columns.LastName, rosterColumnDefaults.LastName); err != nil {
+		return nil, nil, err
+	}
+	if email, err = find(columns.Email, rosterColumnDefaults.Email); err != nil {
+		return nil, nil, err
+	}
+	if username, err = find(columns.Username, rosterColumnDefaults.Username); err != nil {
+		return nil, nil, err
+	}
+	if sid, err = find(columns.StudentID, rosterColumnDefaults.StudentID); err != nil {
+		return nil, nil, err
+	}
+	if name < 0 && (first < 0 || last < 0) {
+		return nil, nil, fmt.Errorf("CSV must have a name column or first and last name columns")
+	}
+	if email < 0 && username < 0 {
+		return nil, nil, fmt.Errorf("CSV must have an email or username column")
+	}
+
+	rows := []*rosterRow{}
+	errs := []*RosterError{}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if perr, ok := err.(*csv.ParseError); ok {
+				errs = append(errs, &RosterError{Line: perr.Line, Message: perr.Err.Error()})
+				continue
+			}
+			return nil, nil, fmt.Errorf("Error reading CSV: %v", err)
+		}
+		line, _ := reader.FieldPos(0)
+		field := func(n int) string {
+			if n < 0 || n >= len(record) {
+				return ""
+			}
+			return strings.TrimSpace(record[n])
+		}
+
+		row := &rosterRow{Line: line, StudentID: field(sid)}
+		if row.Name = field(name); row.Name == "" {
+			row.Name = strings.TrimSpace(field(first) + " " + field(last))
+		}
+		if row.Email = field(email); row.Email == "" {
+			row.Email = field(username)
+		}
+		rows = append(rows, row)
+	}
+	return rows, errs, nil
+}
+
+// expireRosterTokens discards preview tokens that are too old to use
+func expireRosterTokens(now time.Time) {
+	for token, elt := range rosterTokens {
+		if now.After(elt.Expires) {
+			delete(rosterTokens, token)
+		}
+	}
+}
+
+func course_courselistupload(w http.ResponseWriter, r *http.Request, db *sql.DB, instructor *InstructorDB, decoder *json.Decoder) {
+	courseTag := r.URL.Query().Get(":coursetag")
+	course, present := instructor.Courses[courseTag]
+	if !present {
+		log.Printf("Not an instructor for %s/course does not exist", courseTag)
+		http.Error(w, "Course not found", http.StatusNotFound)
+		return
+	}
+
+	now := time.Now().In(timeZone)
+	if now.After(course.Close) {
+		log.Printf("Course is closed")
+		http.Error(w, "Course is closed", http.StatusForbidden)
+		return
+	}
+
+	// accept a plain list of students or an object with options
+	var raw json.RawMessage
+	if err := decoder.Decode(&raw); err != nil {
+		log.Printf("Error decoding list of students: %v", err)
+		http.Error(w, "Error decoding list of students", http.StatusBadRequest)
+		return
+	}
+	req := new(RosterUpload)
+	var err error
+	if trimmed := strings.TrimSpace(string(raw)); strings.HasPrefix(trimmed, "[") {
+		err = json.Unmarshal(raw, &req.Students)
+	} else {
+		err = json.Unmarshal(raw, req)
+	}
+	if err != nil {
+		log.Printf("Error decoding list of students: %v", err)
+		http.Error(w, "Error decoding list of students", http.StatusBadRequest)
+		return
+	}
+
+	switch req.Mode {
+	case "":
+		req.Mode = "sync"
+	case "sync", "merge":
+	default:
+		log.Printf("Unknown roster upload mode: %s", req.Mode)
+		http.Error(w, "Mode must be sync or merge", http.StatusBadRequest)
+		return
+	}
+
+	// gather the rows from the CSV file or the list
+	rows := []*rosterRow{}
+	errs := []*RosterError{}
+	if req.Csv != "" {
+		if len(req.Students) > 0 {
+			log.Printf("Roster upload has both Students and Csv")
+			http.Error(w, "Give Students or Csv, not both", http.StatusBadRequest)
+			return
+		}
+		if rows, errs, err = parseRosterCsv(req.Csv, req.Columns); err != nil {
+			log.Printf("Error parsing roster CSV: %v", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	} else {
+		for i, row := range req.Students {
+			if len(row) != 2 && len(row) != 3 {
+				errs = append(errs, &RosterError{Line: i + 1, Message: fmt.Sprintf("Row has %d elements instead of 2 or 3", len(row))})
+				continue
+			}
+			elt := &rosterRow{Line: i + 1, Name: strings.TrimSpace(row[0]), Email: strings.TrimSpace(row[1])}
+			if len(row) == 3 {
+				elt.StudentID = strings.TrimSpace(row[2])
+			}
+			rows = append(rows, elt)
+		}
+	}
+
+	if len(rows) == 0 && len(errs) == 0 {
+		log.Printf("Course cannot be populated with empty list")
+		http.Error(w, "Course cannot be populated with empty list", http.StatusBadRequest)
+		return
+	}
+
+	// validate the data
+	studentsToAdd := make(map[string]*RosterStudent)
+	lines := make(map[string]int)
+	for _, row := range rows {
+		email := strings.ToLower(row.Email)
+		if row.Name == "" || email == "" {
+			errs = append(errs, &RosterError{Line: row.Line, Message: "Missing name or email"})
+			continue
+		}
+		if !strings.ContainsRune(email, '@') {
+			email += config.StudentEmailDomain
+		}
+		if earlier, present := lines[email]; present {
+			errs = append(errs, &RosterError{Line: row.Line, Message: fmt.Sprintf("%s is already listed on line %d", email, earlier)})
+			continue
+		}
+		lines[email] = row.Line
+		studentsToAdd[email] = &RosterStudent{Email: email, Name: row.Name, StudentID: row.StudentID}
+	}
+
+	changes := getRosterChanges(course, studentsToAdd, req.Mode)
+	changes.Errors = errs
+	sort.Sort(RosterErrorsByLine(changes.Errors))
+	digest := changes.digest(course)
+	expireRosterTokens(now)
+
+	// a preview changes nothing, but hands out a token if the sync
+	// would remove anyone
+	if req.Preview {
+		if len(changes.Removed) > 0 && len(errs) == 0 {
+			token, err := randomToken()
+			if err != nil {
+				log.Printf("Error generating roster token: %v", err)
+				http.Error(w, "Error generating token", http.StatusInternalServerError)
+				return
+			}
+			rosterTokens[token] = &rosterToken{
+				Course:     course.Tag,
+				Instructor: instructor.Email,
+				Digest:     digest,
+				Expires:    now.Add(rosterTokenLifetime),
+			}
+			changes.Token = token
+		}
+		writeJson(w, r, changes)
+		return
+	}
+
+	// in a sync, a bad row could be a student who would be dropped, so
+	// nothing is changed until every row is right. A merge never drops
+	// anyone, so the good rows are applied and the bad ones reported.
+	if len(errs) > 0 {
+		log.Printf("Roster %s for %s has %d bad rows", req.Mode, course.Tag, len(errs))
+		if req.Mode == "sync" {
+			writeJsonStatus(w, r, http.StatusBadRequest, changes)
+			return
+		}
+	}
+
+	// removing students requires a token from a matching preview
+	if len(changes.Removed) > 0 {
+		token, present := rosterTokens[req.Token]
+		if !present || !tokensMatch(token.Digest, digest) ||
+			token.Course != course.Tag || token.Instructor != instructor.Email {
+			log.Printf("Roster sync for %s would remove %d students without a matching preview token", course.Tag, len(changes.Removed))
+			http.Error(w, fmt.Sprintf("This upload would remove %d students; preview it first and include the token", len(changes.Removed)), http.StatusConflict)
+			return
+		}
+		delete(rosterTokens, req.Token)
+	}
+
+	// looks good, so start updating
+	txn, err := db.Begin()
+	if err != nil {
+		log.Printf("DB error starting transaction: %v", err)
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	defer txn.Rollback()
+
+	// add/update students records
+	for email, elt := range studentsToAdd {
+		student, present := studentsByEmail[email]
+		if !present {
+			if _, err := txn.Exec("insert into Student values (?, ?, ?)", email, elt.Name, elt.StudentID); err != nil {
+				log.Printf("DB error inserting Student: %v", err)
+				http.Error(w, "DB error", http.StatusInternalServerError)
+				return
+			}
+		} else if student.Name != elt.Name || (elt.StudentID != "" && student.StudentID != elt.StudentID) {
+			if elt.StudentID == "" {
+				elt.StudentID = student.StudentID
+			}
+			if _, err := txn.Exec("update Student set Name = ?, StudentID = ? where Email = ?", elt.Name, elt.StudentID, email); err != nil {
+				log.Printf("DB error updating Student: %v", err)
+				http.Error(w, "DB error", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		// add student to course if not already enrolled
+		if _, present = course.Students[email]; !present {
+			if _, err := txn.Exec("insert into CourseStudent values (?, ?)", course.Tag, email); err != nil {
+				log.Printf("DB error inserting CourseStudent: %v", err)
+				http.Error(w, "DB error", http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+
+	// remove student records from course
+	for _, elt := range changes.Removed {
+		if _, err := txn.Exec("delete from CourseStudent where Course = ? and Student = ?", course.Tag, elt.Email); err != nil {
+			log.Printf("DB error delete from CourseStudent: %v", err)
+			http.Error(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// commit
+	if err = txn.Commit(); err != nil {
+		log.Printf("DB error committing: %v", err)
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+
+	// now update in-memory structures
+	mutex.Lock()
+
+	// add/update students
+	for email, elt := range studentsToAdd {
+		student, present := studentsByEmail[email]
+		if !present {
+			student = &StudentDB{
+				Email:                 email,
+				Name:                  elt.Name,
+				StudentID:             elt.StudentID,
+				Courses:               make(map[string]*CourseDB),
+				SolutionsByAssignment: make(map[int64]*SolutionDB),
+			}
+			studentsByEmail[email] = student
+		}
+		student.Name = elt.Name
+		if elt.StudentID != "" {
+			student.StudentID = elt.StudentID
+		}
+		student.Courses[course.Tag] = course
+		course.Students[email] = student
+	}
+
+	// delete students who have dropped
+	for _, elt := range changes.Removed {
+		student := course.Students[elt.Email]
+		delete(course.Students, elt.Email)
+		delete(student.Courses, course.Tag)
+	}
+	mutex.Unlock()
+
+	changes.Applied = true
+	log.Printf("Roster %s for %s by %s: %d added, %d removed, %d renamed",
+		changes.Mode, course.Tag, instructor.Email, len(changes.Added), len(changes.Removed), len(changes.Renamed))
+
+	writeJson(w, r, changes)
+}
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ScheduleEntry is one assignment in a bulk schedule. The problem can be
+// given by ID or by a tag that belongs to exactly one problem.
+type ScheduleEntry struct {
+	NewAssignment
+	ProblemTag string
+}
+
+type ScheduleRequest struct {
+	Assignments []*ScheduleEntry
+	Schedule    string
+	Format      string
+	DryRun      bool
+}
+
+type ScheduleEntryResult struct {
+	Entry     int
+	ID        int64
+	ProblemID int64
+	Name      string
+	Open      time.Time
+	Close     time.Time
+	Errors    []string
+	Warnings  []string
+}
+
+type ScheduleResponse struct {
+	DryRun  bool
+	Errors  int
+	Created int
+	Entries []*ScheduleEntryResult
+}
+
+// the columns a CSV or YAML schedule may use, by lower-case name
+var scheduleColumns = map[string]bool{
+	"problem":         true,
+	"problemtag":      true,
+	"open":            true,
+	"close":           true,
+	"forcredit":       true,
+	"latedays":        true,
+	"latepenalty":     true,
+	"weight":          true,
+	"maxattempts":     true,
+	"submitinterval":  true,
+	"disabletestruns": true,
+}
+
+// time formats accepted in CSV and YAML schedules, in the local time zone
+var scheduleTimeFormats = []string{
+	time.RFC3339,
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+}
+
+type scheduleRow struct {
+	Entry  int
+	Fields map[string]string
+}
+
+// parseScheduleCsv reads a schedule with a header row naming the columns
+func parseScheduleCsv(text string) ([]*scheduleRow, error) {
+	reader := csv.NewReader(strings.NewReader(text))
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("Error reading CSV schedule: %v", err)
+	}
+	if len(records) < 2 {
+		return nil, fmt.Errorf("CSV schedule needs a header row and at least one assignment")
+	}
+
+	header := records[0]
+	for i, name := range header {
+		header[i] = strings.ToLower(strings.TrimSpace(name))
+		if !scheduleColumns[header[i]] {
+			return nil, fmt.Errorf("Unknown column in CSV schedule: %s", name)
+		}
+	}
+
+	rows := []*scheduleRow{}
+	for i, record := range records[1:] {
+		row := &scheduleRow{Entry: i + 2, Fields: make(map[string]string)}
+		if len(record) > len(header) {
+			return nil, fmt.Errorf("Line %d of CSV schedule has more fields than the header", row.Entry)
+		}
+		for j, value := range record {
+			row.Fields[header[j]] = strings.TrimSpace(value)
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// parseScheduleYaml reads a schedule that is a list of mappings
+func parseScheduleYaml(text string) ([]*scheduleRow, error) {
+	var lst []map[string]interface{}
+	if err := yaml.Unmarshal([]byte(text), &lst); err != nil {
+		return nil, fmt.Errorf("Error reading YAML schedule: %v", err)
+	}
+	if len(lst) == 0 {
+		return nil, fmt.Errorf("YAML schedule has no assignments")
+	}
+
+	rows := []*scheduleRow{}
+	for i, elt := range lst {
+		row := &scheduleRow{Entry: i + 1, Fields: make(map[string]string)}
+		for key, value := range elt {
+			name := strings.ToLower(strings.TrimSpace(key))
+			if !scheduleColumns[name] {
+				return nil, fmt.Errorf("Unknown field in YAML schedule: %s", key)
+			}
+			switch v := value.(type) {
+			case nil:
+				row.Fields[name] = ""
+			case string:
+				row.Fields[name] = strings.TrimSpace(v)
+			case time.Time:
+				row.Fields[name] = v.Format(time.RFC3339)
+			default:
+				row.Fields[name] = fmt.Sprint(v)
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+func parseScheduleTime(s string) (time.Time, error) {
+	for _, layout := range scheduleTimeFormats {
+		if t, err := time.ParseInLocation(layout, s, timeZone); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("not a recognized time: %s", s)
+}
+
+// getScheduleEntry converts a schedule row into an entry, returning the
+// errors for any fields that could not be parsed
+func getScheduleEntry(row *scheduleRow) (*ScheduleEntry, []string) {
+	entry := new(ScheduleEntry)
+	errs := []string{}
+	for name, value := range row.Fields {
+		if value == "" {
+			continue
+		}
+		var err error
+		switch name {
+		case "problem":
+			// a number is an ID, anything else is a tag
+			if id, e := strconv.ParseInt(value, 10, 64); e == nil {
+				entry.Problem = id
+			} else {
+				entry.ProblemTag = value
+			}
+		case "problemtag":
+			entry.ProblemTag = value
+		case "open":
+			entry.Open, err = parseScheduleTime(value)
+		case "close":
+			entry.Close, err = parseScheduleTime(value)
+		case "forcredit":
+			entry.ForCredit, err = strconv.ParseBool(value)
+		case "latedays":
+			entry.LateDays, err = strconv.Atoi(value)
+		case "latepenalty":
+			entry.LatePenalty, err = strconv.Atoi(value)
+		case "weight":
+			var weight float64
+			weight, err = strconv.ParseFloat(value, 64)
+			entry.Weight = &weight
+		case "maxattempts":
+			entry.MaxAttempts, err = strconv.Atoi(value)
+		case "submitinterval":
+			entry.SubmitInterval, err = strconv.Atoi(value)
+		case "disabletestruns":
+			entry.DisableTestRuns, err = strconv.ParseBool(value)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("Invalid value for %s: %s", name, value))
+		}
+	}
+	return entry, errs
+}
+
+// getScheduleProblem finds the problem an entry refers to
+func getScheduleProblem(entry *ScheduleEntry) (*ProblemDB, error) {
+	var problem *ProblemDB
+	if entry.Problem != 0 {
+		elt, present := problemsByID[entry.Problem]
+		if !present {
+			return nil, fmt.Errorf("Problem %d not found", entry.Problem)
+		}
+		problem = elt
+	}
+	if entry.ProblemTag != "" {
+		tag, present := tagsByTag[entry.ProblemTag]
+		if !present || len(tag.Problems) == 0 {
+			return nil, fmt.Errorf("No problem has tag %s", entry.ProblemTag)
+		}
+		if len(tag.Problems) > 1 {
+			return nil, fmt.Errorf("Tag %s belongs to %d problems; use a problem ID instead", entry.ProblemTag, len(tag.Problems))
+		}
+		for _, elt := range tag.Problems {
+			if problem != nil && problem != elt {
+				return nil, fmt.Errorf("Problem %d does not have tag %s", problem.ID, entry.ProblemTag)
+			}
+			problem = elt
+		}
+	}
+	if problem == nil {
+		return nil, fmt.Errorf("Missing problem")
+	}
+	return problem, nil
+}
+
+func course_scheduleassignments(w http.ResponseWriter, r *http.Request, db *sql.DB, instructor *InstructorDB, decoder *json.Decoder) {
+	courseTag := r.URL.Query().Get(":coursetag")
+	course, present := instructor.Courses[courseTag]
+	if !present {
+		log.Printf("Not an instructor for %s/course does not exist", courseTag)
+		http.Error(w, "Course not found", http.StatusNotFound)
+		return
+	}
+
+	now := time.Now().In(timeZone)
+	if now.After(course.Close) {
+		log.Printf("Course %s is closed", courseTag)
+		http.Error(w, "Course is closed", http.StatusForbidden)
+		return
+	}
+
+	req := new(ScheduleRequest)
+	if err := decoder.Decode(req); err != nil {
+		log.Printf("Failure decoding JSON request: %v", err)
+		http.Error(w, "Failure decoding JSON request", http.StatusBadRequest)
+		return
+	}
+
+	// gather the entries from the list or the schedule file
+	entries := req.Assignments
+	results := []*ScheduleEntryResult{}
+	if strings.TrimSpace(req.Schedule) != "" {
+		if len(entries) > 0 {
+			log.Printf("Schedule request has both Assignments and Schedule")
+			http.Error(w, "Give Assignments or Schedule, not both", http.StatusBadRequest)
+			return
+		}
+		var rows []*scheduleRow
+		var err error
+		switch strings.ToLower(req.Format) {
+		case "", "csv":
+			rows, err = parseScheduleCsv(req.Schedule)
+		case "yaml":
+			rows, err = parseScheduleYaml(req.Schedule)
+		default:
+			err = fmt.Errorf("Unknown schedule format: %s", req.Format)
+		}
+		if err != nil {
+			log.Printf("Error parsing schedule: %v", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, row := range rows {
+			entry, errs := getScheduleEntry(row)
+			entries = append(entries, entry)
+			results = append(results, &ScheduleEntryResult{Entry: row.Entry, Errors: errs})
+		}
+	} else {
+		for i, _ := range entries {
+			results = append(results, &ScheduleEntryResult{Entry: i + 1, Errors: []string{}})
+		}
+	}
+	if len(entries) == 0 {
+		log.Printf("Empty assignment schedule")
+		http.Error(w, "Schedule has no assignments", http.StatusBadRequest)
+		return
+	}
+
+	// validate every entry with the same rules as a single new assignment
+	resp := &ScheduleResponse{DryRun: req.DryRun, Entries: results}
+	problems := make([]*ProblemDB, len(entries))
+	seen := make(map[int64]int)
+	for i, entry := range entries {
+		result := results[i]
+		result.Warnings = []string{}
+		if entry == nil {
+			result.Errors = append(result.Errors, "Missing assignment")
+			resp.Errors++
+			continue
+		}
+		problem, err := getScheduleProblem(entry)
+		if err != nil {
+			result.Errors = append(result.Errors, err.Error())
+		} else {
+			problems[i] = problem
+			result.ProblemID = problem.ID
+			result.Name = problem.Name
+		}
+		if err := newAssignmentError(&entry.NewAssignment, now); err != nil {
+			result.Errors = append(result.Errors, err.Error())
+		}
+		result.Open = entry.Open
+		result.Close = entry.Close
+
+		// look for conflicts with other assignments
+		if problem != nil {
+			ids := []int{}
+			for _, asst := range problem.Assignments {
+				if asst.Course == course {
+					ids = append(ids, int(asst.ID))
+				}
+			}
+			sort.Ints(ids)
+			for _, id := range ids {
+				result.Warnings = append(result.Warnings, fmt.Sprintf("Problem is already assigned in this course as assignment %d", id))
+			}
+			if earlier, present := seen[problem.ID]; present {
+				result.Warnings = append(result.Warnings, fmt.Sprintf("Problem is also scheduled by entry %d", earlier))
+			} else {
+				seen[problem.ID] = result.Entry
+			}
+		}
+		if entry.Close.After(course.Close) {
+			result.Warnings = append(result.Warnings, "Closes after the course closes")
+		}
+		if len(result.Errors) > 0 {
+			resp.Errors++
+		}
+	}
+
+	if req.DryRun {
+		writeJson(w, r, resp)
+		return
+	}
+	if resp.Errors > 0 {
+		log.Printf("Schedule for %s has %d entries with errors", course.Tag, resp.Errors)
+		http.Error(w, fmt.Sprintf("%d schedule entries have errors; use DryRun to see them", resp.Errors), http.StatusBadRequest)
+		return
+	}
+
+	// write to the database first, all or nothing
+	txn, err := db.Begin()
+	if err != nil {
+		log.Printf("DB error starting transaction: %v", err)
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+	defer txn.Rollback()
+
+	for i, entry := range entries {
+		asst := &entry.NewAssignment
+		result, err := txn.Exec("insert into Assignment values (null, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+			course.Tag,
+			problems[i].ID,
+			asst.ForCredit,
+			asst.Open,
+			asst.Close,
+			asst.LateDays,
+			asst.LatePenalty,
+			*asst.Weight,
+			asst.MaxAttempts,
+			asst.SubmitInterval,
+			asst.DisableTestRuns)
+		if err != nil {
+			log.Printf("DB error inserting new Assignment: %v", err)
+			http.Error(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+		if results[i].ID, err = result.LastInsertId(); err != nil {
+			log.Printf("DB error getting ID of new Assignment: %v", err)
+			http.Error(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err = txn.Commit(); err != nil {
+		log.Printf("DB error committing: %v", err)
+		http.Error(w, "DB error", http.StatusInternalServerError)
+		return
+	}
+
+	// update in-memory data structures
+	mutex.Lock()
+	for i, entry := range entries {
+		asst := &entry.NewAssignment
+		problem := problems[i]
+		elt := &AssignmentDB{
+			ID:                 results[i].ID,
+			Course:             course,
+			Problem:            problem,
+			ForCredit:          asst.ForCredit,
+			Open:               asst.Open,
+			Close:              asst.Close,
+			LateDays:           asst.LateDays,
+			LatePenalty:        asst.LatePenalty,
+			Weight:             *asst.Weight,
+			MaxAttempts:        asst.MaxAttempts,
+			SubmitInterval:     asst.SubmitInterval,
+			DisableTestRuns:    asst.DisableTestRuns,
+			SolutionsByStudent: make(map[string]*SolutionDB),
+			Extensions:         make(map[string]time.Time),
+		}
+		assignmentsByID[elt.ID] = elt
+		course.Assignments[elt.ID] = elt
+		problem.Assignments[elt.ID] = elt
+		problem.Courses[course.Tag] = course
+	}
+	mutex.Unlock()
+	resp.Created = len(entries)
+
+	log.Printf("%d assignments scheduled for %s by %s", resp.Created, course.Tag, instructor.Email)
+
+	writeJson(w, r, resp)
+}
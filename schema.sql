@@ -13,7 +13,8 @@ create table Instructor (
 
 create table Student (
     Email text primary key not null,
-    Name text not null
+    Name text not null,
+    StudentID text not null default ''
 );
 
 create table Course (
@@ -69,11 +70,27 @@ create table Assignment (
     ForCredit integer not null,
     Open timestamp not null,
     Close timestamp not null,
+    LateDays integer not null default 0,
+    LatePenalty integer not null default 0,
+    Weight real not null default 1,
+    MaxAttempts integer not null default 0,
+    SubmitInterval integer not null default 0,
+    DisableTestRuns integer not null default 0,
 
     foreign key (Course) references Course (Tag),
     foreign key (Problem) references Problem (ID)
 );
 
+create table Extension (
+    Assignment integer not null,
+    Student text not null,
+    Close timestamp not null,
+
+    primary key (Assignment, Student),
+    foreign key (Assignment) references Assignment (ID),
+    foreign key (Student) references Student (Email)
+);
+
 create table Solution (
     ID integer primary key autoincrement,
     Student text not null,
@@ -89,8 +106,41 @@ create table Submission (
     Submission text not null,
     GradeReport text not null,
     Passed integer,
+    Late integer not null default 0,
+    Penalty integer not null default 0,
+    Score real not null default 0,
+    MaxScore real not null default 0,
 
     primary key (Solution, TimeStamp),
     foreign key (Solution) references Solution (ID)
 );
 create index submission_timestamp on Submission (TimeStamp);
+
+create table GradingRun (
+    Solution integer not null,
+    TimeStamp timestamp not null,
+    Started timestamp not null,
+    Duration integer not null,
+    Grader text not null,
+    Version text not null,
+    GradeReport text not null,
+    Passed integer,
+    Error text not null,
+
+    foreign key (Solution, TimeStamp) references Submission (Solution, TimeStamp)
+);
+create index gradingrun_submission on GradingRun (Solution, TimeStamp);
+
+create table Comment (
+    ID integer primary key autoincrement,
+    Solution integer not null,
+    TimeStamp timestamp not null,
+    Instructor text not null,
+    Created timestamp not null,
+    Line integer not null default 0,
+    Body text not null,
+    Read integer not null default 0,
+
+    foreign key (Solution, TimeStamp) references Submission (Solution, TimeStamp),
+    foreign key (Instructor) references Instructor (Email)
+);
@@ -9,6 +9,7 @@ import (
 	"github.com/gorilla/pat"
 	"github.com/russross/blackfriday"
 	"log"
+	"math"
 	"net/http"
 	"path/filepath"
 	"regexp"
@@ -20,10 +21,13 @@ import (
 func init() {
 	r := pat.New()
 	r.Add("GET", `/student/courses`, handlerStudent(student_courses))
-	r.Add("GET", `/student/assignment/{id:\d+$}`, handlerStudent(student_assignment))
-	r.Add("GET", `/student/submission/{id:\d+}/{n:\d+$}`, handlerStudent(student_assignment))
-	r.Add("GET", `/student/download/{id:\d+$}`, handlerStudent(student_download))
+	r.Add("GET", `/student/assignment/{id:\d+$}`, handlerStudentUnlocked(student_assignment))
+	r.Add("GET", `/student/submission/{id:\d+}/{n:\d+$}`, handlerStudentUnlocked(student_assignment))
+	r.Add("GET", `/student/download/{id:\d+$}`, handlerStudentUnlocked(student_download))
+	r.Add("GET", `/student/events`, handlerStudentStream(student_events))
 	r.Add("POST", `/student/submit/{id:\d+$}`, handlerStudentJson(student_submit))
+	r.Add("POST", `/student/testrun/{id:\d+$}`, handlerStudentJsonUnlocked(student_testrun))
+	r.Add("POST", `/student/readcomments/{id:\d+$}`, handlerStudentJson(student_readcomments))
 	http.Handle("/student/", r)
 }
 
@@ -52,7 +56,7 @@ func getCourseListing(course *CourseDB, student *StudentDB) *CourseListing {
 		elt.Instructors = append(elt.Instructors, email)
 	}
 	for _, asst := range course.Assignments {
-		if now.After(asst.Close) {
+		if now.After(getLateClose(asst, student)) {
 			elt.PastAssignments = append(elt.PastAssignments, getAssignmentListing(asst, student))
 		} else if now.Before(asst.Open) {
 			elt.FutureAssignments = append(elt.FutureAssignments, getAssignmentListing(asst, student))
@@ -68,16 +72,28 @@ func getCourseListing(course *CourseDB, student *StudentDB) *CourseListing {
 }
 
 type AssignmentListing struct {
-	ID             int64
-	Name           string
-	Open           time.Time
-	Close          time.Time
-	Active         bool
-	ForCredit      bool
-	Attempts       int
-	ToBeGraded     int
-	Passed         bool
-	LastSubmission string
+	ID              int64
+	Name            string
+	Open            time.Time
+	Close           time.Time
+	Active          bool
+	ForCredit       bool
+	Extended        bool
+	LateDays        int
+	LatePenalty     int
+	Weight          float64
+	MaxAttempts     int
+	SubmitInterval  int
+	DisableTestRuns bool
+	Attempts        int
+	ToBeGraded      int
+	Passed          bool
+	Late            bool
+	Score           float64
+	MaxScore        float64
+	Credit          int
+	UnreadComments  int
+	LastSubmission  string
 }
 
 type AssignmentsByOpen []*AssignmentListing
@@ -104,23 +120,42 @@ func (p AssignmentsByClose) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
 
 func getAssignmentListing(asst *AssignmentDB, student *StudentDB) *AssignmentListing {
 	now := time.Now().In(timeZone)
+	closeTime := getClose(asst, student)
 	elt := &AssignmentListing{
-		ID:        asst.ID,
-		Name:      asst.Problem.Name,
-		Open:      asst.Open,
-		Close:     asst.Close,
-		Active:    now.After(asst.Open) && now.Before(asst.Close),
-		ForCredit: asst.ForCredit,
+		ID:              asst.ID,
+		Name:            asst.Problem.Name,
+		Open:            asst.Open,
+		Close:           closeTime,
+		Active:          now.After(asst.Open) && now.Before(getLateClose(asst, student)),
+		ForCredit:       asst.ForCredit,
+		Extended:        !closeTime.Equal(asst.Close),
+		LateDays:        asst.LateDays,
+		LatePenalty:     asst.LatePenalty,
+		Weight:          asst.Weight,
+		MaxAttempts:     asst.MaxAttempts,
+		SubmitInterval:  asst.SubmitInterval,
+		DisableTestRuns: asst.DisableTestRuns,
 	}
 	if student != nil {
 		sol, present := student.SolutionsByAssignment[asst.ID]
 		if present {
 			elt.Attempts = len(sol.SubmissionsInOrder)
+			for _, submission := range sol.SubmissionsInOrder {
+				for _, comment := range submission.Comments {
+					if !comment.Read {
+						elt.UnreadComments++
+					}
+				}
+			}
 			for i := len(sol.SubmissionsInOrder) - 1; i >= 0; i-- {
 				submission := sol.SubmissionsInOrder[i]
 				if len(submission.GradeReport) > 0 {
 					// record whether the last graded submission was a pass
 					elt.Passed = submission.Passed
+					elt.Late = submission.Late
+					elt.Score = submission.Score
+					elt.MaxScore = submission.MaxScore
+					elt.Credit = int(math.Floor(getCredit(submission) + 0.5))
 
 					// grab the last submission if the student did not pass
 					if !elt.Passed {
@@ -170,15 +205,20 @@ type StudentAssignmentResult struct {
 	ProblemType *ProblemType
 	Assignment  *AssignmentListing
 	Data        map[string]interface{}
+	Comments    []*CommentListing
 }
 
-func getStudentAssignmentData(w http.ResponseWriter, r *http.Request, student *StudentDB, id int64, n int) (*CourseDB, *AssignmentDB, map[string]interface{}) {
+// getStudentAssignmentData gathers the problem and attempt fields the
+// student may see, along with a request for the expected output. The
+// caller must hold the read lock, and should release it before asking
+// the grader for the output.
+func getStudentAssignmentData(w http.ResponseWriter, r *http.Request, student *StudentDB, id int64, n int) (*CourseDB, *AssignmentDB, map[string]interface{}, *OutputRequest) {
 	// find the assignment
 	asst, present := assignmentsByID[id]
 	if !present {
 		log.Printf("No such assignment: %d", id)
 		http.Error(w, "Not found", http.StatusNotFound)
-		return nil, nil, nil
+		return nil, nil, nil, nil
 	}
 
 	// make sure the assignment is active or past
@@ -186,7 +226,7 @@ func getStudentAssignmentData(w http.ResponseWriter, r *http.Request, student *S
 	if now.Before(asst.Open) {
 		log.Printf("Assignment is not yet open: %d", asst.ID)
 		http.Error(w, "Assignment not open yet", http.StatusForbidden)
-		return nil, nil, nil
+		return nil, nil, nil, nil
 	}
 
 	// find the course
@@ -196,14 +236,14 @@ func getStudentAssignmentData(w http.ResponseWriter, r *http.Request, student *S
 	if now.After(course.Close) {
 		log.Printf("Course is not active: %s", course.Tag)
 		http.Error(w, "Course not active", http.StatusForbidden)
-		return nil, nil, nil
+		return nil, nil, nil, nil
 	}
 
 	// make sure the student is in the course
 	if _, present := student.Courses[course.Tag]; !present {
 		log.Printf("Student not enrolled in course: %s", course.Tag)
 		http.Error(w, "Not enrolled in course", http.StatusForbidden)
-		return nil, nil, nil
+		return nil, nil, nil, nil
 	}
 
 	// get the problem
@@ -225,7 +265,7 @@ func getStudentAssignmentData(w http.ResponseWriter, r *http.Request, student *S
 	if n != -1 && (n < 0 || n >= count) {
 		log.Printf("Invalid solution number requested: %d with %d available", n, count)
 		http.Error(w, "Submission not found", http.StatusNotFound)
-		return nil, nil, nil
+		return nil, nil, nil, nil
 	}
 
 	// get the requested submission
@@ -235,23 +275,28 @@ func getStudentAssignmentData(w http.ResponseWriter, r *http.Request, student *S
 		for key, value := range attempt {
 			data[key] = value
 		}
-		if len(submission.GradeReport) > 0 {
-			report := filterFields("grader", "edit", problemType, submission.GradeReport)
-			for _, field := range problemType.FieldList {
-				if value, present := report[field.Name]; present && field.Result == "view" {
-					data[field.Name] = value
-				}
-			}
+		for key, value := range getReportResults(problemType, submission.GradeReport) {
+			data[key] = value
 		}
 	}
 
-	// include the expected output if available
-	output, err := getOutput(problem)
-	if err == nil {
-		data["Output"] = output
-	}
+	return course, asst, data, newOutputRequest(problem)
+}
 
-	return course, asst, data
+// getReportResults filters a grade report down to the fields the
+// student is allowed to see
+func getReportResults(problemType *ProblemType, gradeReport map[string]interface{}) map[string]interface{} {
+	results := make(map[string]interface{})
+	if len(gradeReport) == 0 {
+		return results
+	}
+	report := filterFields("grader", "edit", problemType, gradeReport)
+	for _, field := range problemType.FieldList {
+		if value, present := report[field.Name]; present && field.Result == "view" {
+			results[field.Name] = value
+		}
+	}
+	return results
 }
 
 func student_assignment(w http.ResponseWriter, r *http.Request, student *StudentDB) {
@@ -274,8 +319,10 @@ func student_assignment(w http.ResponseWriter, r *http.Request, student *Student
 	}
 
 	// get the data to return
-	course, asst, data := getStudentAssignmentData(w, r, student, id, n)
+	mutex.RLock()
+	course, asst, data, outputReq := getStudentAssignmentData(w, r, student, id, n)
 	if data == nil || len(data) == 0 {
+		mutex.RUnlock()
 		return
 	}
 
@@ -285,24 +332,73 @@ func student_assignment(w http.ResponseWriter, r *http.Request, student *Student
 		ProblemType: asst.Problem.Type,
 		Assignment:  getAssignmentListing(asst, student),
 		Data:        data,
+		Comments:    []*CommentListing{},
+	}
+	if solution, present := student.SolutionsByAssignment[asst.ID]; present {
+		resp.Comments = getCommentListings(solution)
+	}
+	mutex.RUnlock()
+
+	// include the expected output if available
+	if output, err := getOutput(outputReq); err == nil {
+		data["Output"] = output
 	}
 
 	writeJson(w, r, resp)
 }
 
-func student_submit(w http.ResponseWriter, r *http.Request, db *sql.DB, student *StudentDB, decoder *json.Decoder) {
+// checkSubmitLimits decides if a student may submit an attempt now. It
+// returns an HTTP status and message if not, and how long the student
+// should wait before trying again (if waiting will help).
+func checkSubmitLimits(asst *AssignmentDB, student *StudentDB, now time.Time) (status int, msg string, wait time.Duration) {
+	// per-assignment limits
+	if solution, present := student.SolutionsByAssignment[asst.ID]; present && len(solution.SubmissionsInOrder) > 0 {
+		subs := solution.SubmissionsInOrder
+		if asst.MaxAttempts > 0 && len(subs) >= asst.MaxAttempts {
+			return http.StatusForbidden, fmt.Sprintf("No attempts left; the limit is %d", asst.MaxAttempts), 0
+		}
+		interval := time.Duration(asst.SubmitInterval) * time.Second
+		if next := subs[len(subs)-1].TimeStamp.Add(interval); now.Before(next) {
+			return http.StatusTooManyRequests, fmt.Sprintf("Must wait %d seconds between attempts", asst.SubmitInterval), next.Sub(now)
+		}
+	}
+
+	// limit for all assignments together
+	if config.SubmissionsPerMinute > 0 {
+		start := now.Add(-time.Minute)
+		var recent []time.Time
+		for _, solution := range student.SolutionsByAssignment {
+			for i := len(solution.SubmissionsInOrder) - 1; i >= 0; i-- {
+				sub := solution.SubmissionsInOrder[i]
+				if !sub.TimeStamp.After(start) {
+					break
+				}
+				recent = append(recent, sub.TimeStamp)
+			}
+		}
+		if len(recent) >= config.SubmissionsPerMinute {
+			// wait until the oldest one in the window expires
+			oldest := recent[0]
+			for _, elt := range recent {
+				if elt.Before(oldest) {
+					oldest = elt
+				}
+			}
+			return http.StatusTooManyRequests, "Too many submissions; try again in a minute", oldest.Add(time.Minute).Sub(now)
+		}
+	}
+
+	return http.StatusOK, "", 0
+}
+
+// getStudentActiveAssignment finds the assignment named in the request
+// and makes sure the student can submit to it now
+func getStudentActiveAssignment(w http.ResponseWriter, r *http.Request, student *StudentDB, now time.Time) *AssignmentDB {
 	asstID, err := strconv.ParseInt(r.URL.Query().Get(":id"), 10, 64)
 	if err != nil {
 		log.Printf("Bad assignment ID: %s", r.URL.Query().Get(":id"))
 		http.Error(w, "Assignment not found", http.StatusNotFound)
-		return
-	}
-
-	data := make(map[string]interface{})
-	if err := decoder.Decode(&data); err != nil {
-		log.Printf("Failure decoding JSON request: %v", err)
-		http.Error(w, "Failure decoding JSON request", http.StatusBadRequest)
-		return
+		return nil
 	}
 
 	// make sure this assignment exists
@@ -310,23 +406,16 @@ func student_submit(w http.ResponseWriter, r *http.Request, db *sql.DB, student
 	if !present {
 		log.Printf("No such assignment: %d", asstID)
 		http.Error(w, "Assignment not found", http.StatusNotFound)
-		return
+		return nil
 	}
 
 	// make sure the assignment is active
-	now := time.Now().In(timeZone)
-	if now.Before(asst.Open) || now.After(asst.Close) {
+	if now.Before(asst.Open) || now.After(getLateClose(asst, student)) {
 		log.Printf("Assignment is not active: %d", asstID)
 		http.Error(w, "Assignment not active", http.StatusForbidden)
-		return
+		return nil
 	}
 
-	// get the problem type description
-	problemType := asst.Problem.Type
-
-	// filter it down to expected student fields
-	filtered := filterFields("student", "edit", problemType, data)
-
 	// get the course
 	course := asst.Course
 
@@ -334,13 +423,46 @@ func student_submit(w http.ResponseWriter, r *http.Request, db *sql.DB, student
 	if now.After(course.Close) {
 		log.Printf("Not an active course: %s", course.Tag)
 		http.Error(w, "Not an active course", http.StatusNotFound)
-		return
+		return nil
 	}
 
 	// make sure the student is enrolled in the course
 	if _, present := student.Courses[course.Tag]; !present {
 		log.Printf("Not enrolled in the course: %s", course.Tag)
 		http.Error(w, "Not enrolled in the course", http.StatusForbidden)
+		return nil
+	}
+
+	return asst
+}
+
+func student_submit(w http.ResponseWriter, r *http.Request, db *sql.DB, student *StudentDB, decoder *json.Decoder) {
+	now := time.Now().In(timeZone)
+	asst := getStudentActiveAssignment(w, r, student, now)
+	if asst == nil {
+		return
+	}
+
+	data := make(map[string]interface{})
+	if err := decoder.Decode(&data); err != nil {
+		log.Printf("Failure decoding JSON request: %v", err)
+		http.Error(w, "Failure decoding JSON request", http.StatusBadRequest)
+		return
+	}
+
+	// get the problem type description
+	problemType := asst.Problem.Type
+
+	// filter it down to expected student fields
+	filtered := filterFields("student", "edit", problemType, data)
+
+	// make sure the student is not over the limits
+	if status, msg, wait := checkSubmitLimits(asst, student, now); status != http.StatusOK {
+		log.Printf("Submission refused for %s on assignment %d: %s", student.Email, asst.ID, msg)
+		if wait > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int((wait+time.Second-1)/time.Second)))
+		}
+		http.Error(w, msg, status)
 		return
 	}
 
@@ -355,7 +477,7 @@ func student_submit(w http.ResponseWriter, r *http.Request, db *sql.DB, student
 	defer txn.Rollback()
 
 	// is this the first submission for this assignment?
-	solution, solutionPresent := student.SolutionsByAssignment[asstID]
+	solution, solutionPresent := student.SolutionsByAssignment[asst.ID]
 	if !solutionPresent {
 		result, err := txn.Exec("insert into Solution values (null, ?, ?)",
 			student.Email,
@@ -386,13 +508,21 @@ func student_submit(w http.ResponseWriter, r *http.Request, db *sql.DB, student
 		return
 	}
 
+	// submissions in the late window are accepted with a penalty
+	late := now.After(getClose(asst, student))
+	penalty := getLatePenalty(asst, student, now)
+
 	// create the submission
-	_, err = txn.Exec("insert into Submission values (?, ?, ?, ?, ?)",
+	_, err = txn.Exec("insert into Submission values (?, ?, ?, ?, ?, ?, ?, ?, ?)",
 		solution.ID,
 		now,
 		submissionJson,
 		"",
-		false)
+		false,
+		late,
+		penalty,
+		0,
+		0)
 	if err != nil {
 		log.Printf("DB insert error on Submission: %v", err)
 		http.Error(w, "DB error", http.StatusInternalServerError)
@@ -407,6 +537,7 @@ func student_submit(w http.ResponseWriter, r *http.Request, db *sql.DB, student
 	}
 
 	// add the solution to memory if needed
+	mutex.Lock()
 	if !solutionPresent {
 		solutionsByID[solution.ID] = solution
 		student.SolutionsByAssignment[asst.ID] = solution
@@ -420,11 +551,59 @@ func student_submit(w http.ResponseWriter, r *http.Request, db *sql.DB, student
 		Submission:  filtered,
 		GradeReport: make(map[string]interface{}),
 		Passed:      false,
+		Late:        late,
+		Penalty:     penalty,
 	}
 	solution.SubmissionsInOrder = append(solution.SubmissionsInOrder, sub)
+	mutex.Unlock()
 
 	// notify the grader of work to do
-	notifyGrader <- solution.ID
+	queueForGrading(sub)
+
+	publishGradeEvent("submitted", sub)
+}
+
+// student_events streams events as the student's submissions are
+// received and graded
+func student_events(w http.ResponseWriter, r *http.Request, student *StudentDB) *eventStream {
+	return openEventStream("", student.Email)
+}
+
+// student_readcomments marks every comment on the student's submissions
+// for an assignment as read
+func student_readcomments(w http.ResponseWriter, r *http.Request, db *sql.DB, student *StudentDB, decoder *json.Decoder) {
+	id, err := strconv.ParseInt(r.URL.Query().Get(":id"), 10, 64)
+	if err != nil {
+		log.Printf("Bad assignment ID: %s", r.URL.Query().Get(":id"))
+		http.Error(w, "Assignment not found", http.StatusNotFound)
+		return
+	}
+	asst, present := assignmentsByID[id]
+	if !present {
+		log.Printf("No such assignment: %d", id)
+		http.Error(w, "Assignment not found", http.StatusNotFound)
+		return
+	}
+
+	solution, present := student.SolutionsByAssignment[asst.ID]
+	if present {
+		// write to the database first
+		if _, err := db.Exec("update Comment set Read = ? where Solution = ?", true, solution.ID); err != nil {
+			log.Printf("DB error marking comments read: %v", err)
+			http.Error(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+
+		mutex.Lock()
+		for _, sub := range solution.SubmissionsInOrder {
+			for _, comment := range sub.Comments {
+				comment.Read = true
+			}
+		}
+		mutex.Unlock()
+	}
+
+	writeJson(w, r, getAssignmentListing(asst, student))
 }
 
 func student_download(w http.ResponseWriter, r *http.Request, student *StudentDB) {
@@ -436,12 +615,21 @@ func student_download(w http.ResponseWriter, r *http.Request, student *StudentDB
 	}
 
 	// get the data to download
-	_, asst, data := getStudentAssignmentData(w, r, student, id, -1)
+	mutex.RLock()
+	_, asst, data, outputReq := getStudentAssignmentData(w, r, student, id, -1)
+	mutex.RUnlock()
 	if data == nil || len(data) == 0 {
 		return
 	}
 
+	// include the expected output if available
+	if output, err := getOutput(outputReq); err == nil {
+		data["Output"] = output
+	}
+
+	mutex.RLock()
 	filename, zipfile, err := makeProblemZipFile(asst.Problem, data)
+	mutex.RUnlock()
 	if err != nil {
 		http.Error(w, "Failed to create zipfile", http.StatusInternalServerError)
 	}
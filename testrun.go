@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Test runs send an attempt to the grader and return the report right
+// away, without recording anything. Each student may have one test run
+// at a time, and TestRunsPerMinute limits how often they start.
+var testRunsByStudent = make(map[string][]time.Time)
+var testRunsInProgress = make(map[string]bool)
+var testRunsMutex sync.Mutex
+var lastTestRunSweep time.Time
+
+// forgetOldTestRuns drops students whose test runs are all more than a
+// minute old, at most once a minute, so the map does not keep every
+// student who ever ran a test. The caller must hold testRunsMutex.
+func forgetOldTestRuns(now time.Time) {
+	if now.Sub(lastTestRunSweep) < time.Minute {
+		return
+	}
+	lastTestRunSweep = now
+	for email, runs := range testRunsByStudent {
+		if len(runs) == 0 || !runs[len(runs)-1].After(now.Add(-time.Minute)) {
+			delete(testRunsByStudent, email)
+		}
+	}
+}
+
+// startTestRun claims a test run for a student. It returns a message
+// and how long to wait if the student is over the limit.
+func startTestRun(email string, now time.Time) (msg string, wait time.Duration) {
+	testRunsMutex.Lock()
+	defer testRunsMutex.Unlock()
+
+	if testRunsInProgress[email] {
+		return "A test run is already in progress", 0
+	}
+	forgetOldTestRuns(now)
+
+	// forget runs from more than a minute ago
+	recent := []time.Time{}
+	for _, elt := range testRunsByStudent[email] {
+		if elt.After(now.Add(-time.Minute)) {
+			recent = append(recent, elt)
+		}
+	}
+	if config.TestRunsPerMinute > 0 && len(recent) >= config.TestRunsPerMinute {
+		testRunsByStudent[email] = recent
+		return "Too many test runs; try again in a minute", recent[0].Add(time.Minute).Sub(now)
+	}
+
+	testRunsByStudent[email] = append(recent, now)
+	testRunsInProgress[email] = true
+	return "", 0
+}
+
+func finishTestRun(email string) {
+	testRunsMutex.Lock()
+	delete(testRunsInProgress, email)
+	testRunsMutex.Unlock()
+}
+
+type TestRunResult struct {
+	Passed   bool
+	Score    float64
+	MaxScore float64
+	Data     map[string]interface{}
+}
+
+func student_testrun(w http.ResponseWriter, r *http.Request, student *StudentDB, decoder *json.Decoder) {
+	now := time.Now().In(timeZone)
+
+	data := make(map[string]interface{})
+	if err := decoder.Decode(&data); err != nil {
+		log.Printf("Failure decoding JSON request: %v", err)
+		http.Error(w, "Failure decoding JSON request", http.StatusBadRequest)
+		return
+	}
+
+	// gather everything while holding the read lock
+	mutex.RLock()
+	asst := getStudentActiveAssignment(w, r, student, now)
+	if asst == nil {
+		mutex.RUnlock()
+		return
+	}
+	if asst.DisableTestRuns {
+		mutex.RUnlock()
+		log.Printf("Test runs are disabled for assignment %d", asst.ID)
+		http.Error(w, "Test runs are disabled for this assignment", http.StatusForbidden)
+		return
+	}
+	problemType := asst.Problem.Type
+	filtered := filterFields("student", "edit", problemType, data)
+	merged := mergeForGrader(asst.Problem, filtered)
+	mutex.RUnlock()
+
+	// make sure the student is not over the limits
+	if msg, wait := startTestRun(student.Email, now); msg != "" {
+		log.Printf("Test run refused for %s on assignment %d: %s", student.Email, asst.ID, msg)
+		if wait > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int((wait+time.Second-1)/time.Second)))
+		}
+		http.Error(w, msg, http.StatusTooManyRequests)
+		return
+	}
+	defer finishTestRun(student.Email)
+
+	// send it to the grader
+	log.Printf("Test run of type %s for %s on assignment %d", problemType.Tag, student.Email, asst.ID)
+	grader, err := graderFor(problemType.Tag)
+	if err != nil {
+		http.Error(w, "No grader available", http.StatusServiceUnavailable)
+		return
+	}
+	report := make(map[string]interface{})
+	err = grader.Do("POST", "/grade/"+problemType.Tag, merged, &report)
+	if err == errGraderUnavailable {
+		http.Error(w, "Grader is unavailable; try again later", http.StatusServiceUnavailable)
+		return
+	}
+	if err == nil {
+		err = checkGradeReport(report)
+	}
+	if err != nil {
+		log.Printf("Test run failed: %v", err)
+		http.Error(w, "Grading failed", http.StatusBadGateway)
+		return
+	}
+
+	resp := &TestRunResult{
+		Passed: report["Passed"].(bool),
+		Data:   getReportResults(problemType, report),
+	}
+	resp.Score, resp.MaxScore = getScore(report)
+
+	writeJson(w, r, resp)
+}